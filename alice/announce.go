@@ -28,21 +28,21 @@ type Announce struct {
 	Peers    []byte // response
 }
 
-func newAnnounce(infoHash, peerID [20]byte, left int, connectionID []byte) *Announce {
+func newAnnounce(req *trackerRequest, connectionID []byte) *Announce {
 	return &Announce{
 		ConnectionID:  connectionID,
-		Action:        1,
+		Action:        actionAnnounce,
 		TransactionID: generateRandomID(4),
-		InfoHash:      infoHash,
-		PeerID:        peerID,
-		Downloaded:    0,
-		Left:          uint64(left),
-		Uploaded:      0,
-		Event:         0,
+		InfoHash:      req.InfoHash,
+		PeerID:        req.PeerID,
+		Downloaded:    uint64(req.Downloaded),
+		Left:          uint64(req.Left),
+		Uploaded:      uint64(req.Uploaded),
+		Event:         uint32(req.Event),
 		IP:            0,
-		Key:           generateRandomID(4),
+		Key:           req.Key,
 		NumWant:       -1,
-		Port:          0,
+		Port:          uint16(req.Port),
 	}
 }
 
@@ -0,0 +1,113 @@
+package alice
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Find the end of the bencoded value starting at pos.
+func skipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("unexpected end of bencoded data")
+	}
+
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at %d", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			var err error
+			pos, err = skipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("unterminated list or dictionary")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := readString(data, pos)
+		return end, err
+	}
+	return 0, fmt.Errorf("invalid bencoded value at %d", pos)
+}
+
+// Read bencoded string starting at pos, returns the string and the end
+// of the value.
+func readString(data []byte, pos int) (string, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 0 {
+		return "", 0, fmt.Errorf("invalid string at %d", pos)
+	}
+	length, err := strconv.Atoi(string(data[pos : pos+colon]))
+	if err != nil || length < 0 {
+		return "", 0, fmt.Errorf("invalid string length at %d", pos)
+	}
+	begin := pos + colon + 1
+	if begin+length > len(data) {
+		return "", 0, fmt.Errorf("string at %d exceeds data", pos)
+	}
+	return string(data[begin : begin+length]), begin + length, nil
+}
+
+// Raw bencoded value stored under key of the dictionary, as it appears
+// in data without re-encoding.
+func rawDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("expected bencoded dictionary")
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		k, end, err := readString(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		valueEnd, err := skipValue(data, end)
+		if err != nil {
+			return nil, err
+		}
+		if k == key {
+			return data[end:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, fmt.Errorf("dictionary has no key %q", key)
+}
+
+// Decode bencoded dictionary.
+func decodeDict(data []byte) (map[string]interface{}, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected bencoded dictionary")
+	}
+	return dict, nil
+}
+
+// Keys of the decoded dictionary that are not in known, nil if there are
+// none.
+func unknownKeys(dict map[string]interface{}, known []string) map[string]interface{} {
+	unknown := make(map[string]interface{})
+	for key, value := range dict {
+		unknown[key] = value
+	}
+	for _, key := range known {
+		delete(unknown, key)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	return unknown
+}
@@ -14,14 +14,33 @@ type Bitfield []byte
 func (bf Bitfield) hasPiece(index int) bool {
 	bfIndex := index / 8 // determine which bitfield we need
 	offset := index % 8  // determine offset within that bitfield
+	if index < 0 || bfIndex >= len(bf) {
+		return false
+	}
 
 	return bf[bfIndex]>>(7-offset)&1 != 0
 }
 
+// Check if bitfield received from peer covers exactly the given number of
+// pieces, spare bits at the end have to be cleared.
+func (bf Bitfield) valid(numPieces int) bool {
+	if len(bf) != (numPieces+7)/8 {
+		return false
+	}
+	if numPieces%8 == 0 {
+		return true
+	}
+	spare := byte(0xff) >> (numPieces % 8)
+	return bf[len(bf)-1]&spare == 0
+}
+
 // Set piece at the given index as available to be sent by peer(s).
 func (bf Bitfield) setPiece(index int) {
 	byteIndex := index / 8
 	offset := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
 
 	bf[byteIndex] |= 1 << (7 - offset)
 }
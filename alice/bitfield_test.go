@@ -0,0 +1,25 @@
+package alice
+
+import "testing"
+
+func TestBitfieldValid(t *testing.T) {
+	tests := []struct {
+		bf        Bitfield
+		numPieces int
+		valid     bool
+	}{
+		{Bitfield{0xff}, 8, true},
+		{Bitfield{0xff, 0x80}, 9, true},
+		{Bitfield{0xff, 0x40}, 9, false},
+		{Bitfield{0xe0}, 3, true},
+		{Bitfield{0xf0}, 3, false},
+		{Bitfield{0xff}, 9, false},
+		{Bitfield{0xff, 0x00}, 8, false},
+		{Bitfield{}, 0, true},
+	}
+	for _, test := range tests {
+		if valid := test.bf.valid(test.numPieces); valid != test.valid {
+			t.Errorf("%08b valid for %d pieces = %t, want %t", []byte(test.bf), test.numPieces, valid, test.valid)
+		}
+	}
+}
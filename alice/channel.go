@@ -1,68 +1,112 @@
 package alice
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 // Represents the communication channel between client and peer.
 type Channel struct {
-	Conn     net.Conn // shared
-	Choked   bool     // shared
-	Bitfield Bitfield // shared
-	peer     Peer     // peer data
-	infoHash [20]byte // client data
-	peerID   [20]byte // client data
+	Conn              net.Conn           // shared
+	Choked            bool               // shared (peer chokes client)
+	Choking           bool               // shared (client chokes peer, guarded by mu)
+	Interested        bool               // shared (peer is interested in client, guarded by mu)
+	Bitfield          Bitfield           // shared
+	counted           bool               // peer data (bitfield counted by the picker)
+	ExtendedHandshake *ExtendedHandshake // peer data (nil until received, guarded by mu)
+	peer              Peer               // peer data
+	remotePeerID      [20]byte           // peer data (from handshake)
+	outgoing          bool               // peer data (connection was dialed)
+	extensions        extensionRegistry  // peer data (guarded by mu)
+	supportsExtension bool               // peer data
+	supportsV2        bool               // peer data (BEP 52 hash messages)
+	uploads           []blockRequest     // peer data (requests to serve)
+	pipeline          pipeline           // peer data (outstanding requests)
+	uploadRate        *rateMeter         // peer data (bytes sent to peer)
+	pexSent           map[string]pexPeer // peer data (peers sent with ut_pex)
+	lastBlock         time.Time          // peer data (last requested block received)
+	infoHash          [20]byte           // client data
+	peerID            [20]byte           // client data
+	torrent           *Torrent           // client data
+	reader            *bufio.Reader      // buffered reads from Conn
+	messages          chan *Message      // messages read in the background
+	readErr           error              // set before messages is closed
+	done              chan struct{}      // closed when channel is closed
+	closeOnce         sync.Once
+	mu                sync.Mutex // serializes writes to Conn
 }
 
-func completeHandshake(conn net.Conn, infoHash, peerID [20]byte) error {
+func completeHandshake(conn net.Conn, request *Handshake) (*Handshake, error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 
-	request := newHandshake(infoHash, peerID)          // initialize Handshake struct
 	_, err := conn.Write(request.serializeHandshake()) // convert it to connection data
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// convert handshake response to Handshake struct
 	result, err := readHandshake(conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// check if info hash sent equals to the one received
-	if !bytes.Equal(result.InfoHash[:], infoHash[:]) {
-		err := fmt.Errorf("expected infohash %x but got %x", infoHash, request.InfoHash)
-		return err
+	if !bytes.Equal(result.InfoHash[:], request.InfoHash[:]) {
+		err := fmt.Errorf("expected infohash %x but got %x", request.InfoHash, result.InfoHash)
+		return nil, err
 	}
 
-	return nil
+	return result, nil
 }
 
 // Receive bitfield peer message right after successful handshake.
-func receiveBitfield(conn net.Conn) (Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+//
+// Extended handshake and keep-alives might be sent before the bitfield.
+// Peers without any pieces are allowed to skip the bitfield.
+func (ch *Channel) receiveBitfield() error {
+	ch.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer ch.Conn.SetDeadline(time.Time{})
 
-	msg, err := readMessage(conn)
-	if err != nil {
-		return nil, err
-	}
+	for {
+		msg, err := ch.read()
+		if err != nil {
+			return err
+		}
 
-	if msg == nil {
-		err := fmt.Errorf("expected bitfield but got keep alive")
-		return nil, err
-	}
+		// keep-alive
+		if msg == nil {
+			continue
+		}
 
-	if msg.ID != bitfield {
-		err := fmt.Errorf("expected bitfield but got message ID %d", msg.ID)
-		return nil, err
-	}
+		if msg.ID == extended && ch.supportsExtension {
+			err := ch.handleExtendedMessage(msg)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg.ID != bitfield {
+			numPieces := ch.torrent.metainfo().numPieces()
+			ch.Bitfield = make(Bitfield, (numPieces+7)/8)
+			return ch.handleMessage(msg)
+		}
 
-	return msg.Payload, nil
+		tf := ch.torrent.metainfo()
+		bf := Bitfield(msg.Payload)
+		// length is unknown until metadata of a magnet link is fetched
+		if tf.Files != nil && !bf.valid(tf.numPieces()) {
+			err := fmt.Errorf("peer %s sent invalid bitfield of length %d", ch.peer, len(bf))
+			return err
+		}
+		ch.Bitfield = bf
+		return nil
+	}
 }
 
 // Create a channel between client and peer.
@@ -72,61 +116,345 @@ func (t *Torrent) newChannel(peer Peer, peerID, infoHash [20]byte) (*Channel, er
 		return nil, err
 	}
 
-	err = completeHandshake(conn, infoHash, peerID)
+	result, err := completeHandshake(conn, t.newHandshake(infoHash, peerID))
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bf, err := receiveBitfield(conn)
+	ch, err := t.setupChannel(conn, peer, result)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	ch.outgoing = true
+	return ch, nil
+}
+
+// Create a channel to the peer of the torrent.
+//
+// Peers of hybrid torrents might only be in the v2 swarm, the truncated
+// v2 info hash is tried if the handshake with the v1 one fails.
+func (t *Torrent) connect(peer Peer) (*Channel, error) {
+	var ch *Channel
+	var err error
+	for _, infoHash := range t.metainfo().infoHashes() {
+		ch, err = t.newChannel(peer, t.peerID, infoHash)
+		if err == nil {
+			return ch, nil
+		}
+		if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Exchange extended handshake and bitfield once handshake is complete.
+func (t *Torrent) setupChannel(conn net.Conn, peer Peer, result *Handshake) (*Channel, error) {
+	ch := &Channel{
+		Conn:              conn,
+		Choked:            true,
+		Choking:           true,
+		peer:              peer,
+		remotePeerID:      result.PeerID,
+		extensions:        newExtensionRegistry(),
+		supportsExtension: result.supportsExtensions(),
+		supportsV2:        result.supportsV2(),
+		infoHash:          result.InfoHash,
+		peerID:            t.peerID,
+		torrent:           t,
+		reader:            bufio.NewReader(conn),
+		pipeline:          newPipeline(),
+		uploadRate:        newRateMeter(),
+		messages:          make(chan *Message, 64),
+		done:              make(chan struct{}),
+	}
+
+	// bitfield has to be the first message after the handshake
+	err := ch.sendBitfield(t.bitfieldCopy())
+	if err != nil {
+		return nil, err
+	}
+
+	if ch.supportsExtension {
+		err := ch.sendExtendedHandshake(newExtendedHandshake(peer, t.port, t.metainfo()))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	t.activePeers++
+	err = ch.receiveBitfield()
+	if err != nil {
+		return nil, err
+	}
 
-	return &Channel{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+	return ch, nil
 }
 
 func (ch *Channel) read() (*Message, error) {
-	msg, err := readMessage(ch.Conn)
+	msg, err := readMessage(ch.reader)
 	return msg, err
 }
 
-func (ch *Channel) sendRequest(index, begin, length int) error {
-	req := createRequestMessage(index, begin, length)
-	_, err := ch.Conn.Write(req.serializeMessage())
-	return err
+// Read messages in the background so that they can be awaited together
+// with other events. Keep-alives are not forwarded.
+//
+// Peers are expected to send keep-alives every two minutes.
+func (ch *Channel) readLoop() {
+	defer close(ch.messages)
+	for {
+		ch.Conn.SetReadDeadline(time.Now().Add(3 * time.Minute))
+		msg, err := ch.read()
+		if err != nil {
+			ch.readErr = err
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		select {
+		case ch.messages <- msg:
+		case <-ch.done:
+			return
+		}
+	}
 }
 
-func (ch *Channel) sendInterested() error {
-	msg := Message{ID: interested}
+// Close connection and stop background reading.
+func (ch *Channel) close() {
+	ch.closeOnce.Do(func() {
+		close(ch.done)
+		ch.Conn.Close()
+	})
+}
+
+// Write message to peer, safe for concurrent use.
+func (ch *Channel) send(msg *Message) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
 	_, err := ch.Conn.Write(msg.serializeMessage())
 	return err
 }
 
+func (ch *Channel) sendKeepAlive() error {
+	var msg *Message
+	return ch.send(msg)
+}
+
+func (ch *Channel) sendRequest(index, begin, length int) error {
+	return ch.send(createRequestMessage(index, begin, length))
+}
+
+func (ch *Channel) sendCancel(index, begin, length int) error {
+	return ch.send(createCancelMessage(index, begin, length))
+}
+
+func (ch *Channel) sendInterested() error {
+	return ch.send(&Message{ID: interested})
+}
+
 func (ch *Channel) sendNotInterested() error {
-	msg := Message{ID: notInterested}
-	_, err := ch.Conn.Write(msg.serializeMessage())
-	return err
+	return ch.send(&Message{ID: notInterested})
 }
 
+// Unchoke peer, nothing is sent if peer is already unchoked.
 func (ch *Channel) sendUnchoke() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.Choking {
+		return nil
+	}
+	ch.Choking = false
 	msg := Message{ID: unchoke}
 	_, err := ch.Conn.Write(msg.serializeMessage())
 	return err
 }
 
-func (ch *Channel) sendHave(index int) error {
-	msg := createHaveMessage(index)
+// Choke peer, nothing is sent if peer is already choked.
+func (ch *Channel) sendChoke() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.Choking {
+		return nil
+	}
+	ch.Choking = true
+	msg := Message{ID: choke}
 	_, err := ch.Conn.Write(msg.serializeMessage())
 	return err
 }
+
+func (ch *Channel) isChoking() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.Choking
+}
+
+func (ch *Channel) isInterested() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.Interested
+}
+
+func (ch *Channel) setInterested(interested bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.Interested = interested
+}
+
+func (ch *Channel) sendHave(index int) error {
+	return ch.send(createHaveMessage(index))
+}
+
+// Send pieces client has, skipped if client has none.
+func (ch *Channel) sendBitfield(bf Bitfield) error {
+	for _, b := range bf {
+		if b != 0 {
+			return ch.send(&Message{ID: bitfield, Payload: bf})
+		}
+	}
+	return nil
+}
+
+// Process message common to downloading and seeding.
+//
+// PIECE messages are handled by the downloader itself.
+func (ch *Channel) handleMessage(msg *Message) error {
+	switch msg.ID {
+	case unchoke:
+		ch.Choked = false
+	case choke:
+		ch.Choked = true
+	case interested:
+		ch.setInterested(true)
+		ch.torrent.requestRechoke()
+	case notInterested:
+		ch.setInterested(false)
+		ch.uploads = nil
+	case have:
+		index, err := readHaveMessage(msg)
+		if err != nil {
+			return err
+		}
+		if !ch.Bitfield.hasPiece(index) {
+			ch.Bitfield.setPiece(index)
+			// picker counts the whole bitfield when the peer is added
+			if ch.counted {
+				ch.torrent.picker.peerHas(index)
+			}
+		}
+	case request:
+		index, begin, length, err := readRequestMessage(msg)
+		if err != nil {
+			return err
+		}
+		ch.queueUpload(blockRequest{index, begin, length})
+	case cancel:
+		index, begin, length, err := readRequestMessage(msg)
+		if err != nil {
+			return err
+		}
+		ch.cancelUpload(blockRequest{index, begin, length})
+	case extended:
+		return ch.handleExtendedMessage(msg)
+	case hashRequest:
+		return ch.serveHashRequest(msg)
+	}
+	return nil
+}
+
+func (ch *Channel) sendExtendedHandshake(hs *ExtendedHandshake) error {
+	msg, err := createExtendedHandshake(hs)
+	if err != nil {
+		return err
+	}
+	return ch.send(msg)
+}
+
+// Extended message ID peer expects for the named extension.
+func (ch *Channel) remoteExtensionID(name string) (uint8, bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.extensions.remoteID(name)
+}
+
+// Listen port from the extended handshake, 0 if unknown.
+func (ch *Channel) listenPort() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.ExtendedHandshake == nil {
+		return 0
+	}
+	return ch.ExtendedHandshake.P
+}
+
+// Address the peer accepts connections on, the connection address of
+// incoming peers has a different port.
+func (ch *Channel) listenAddr() Peer {
+	if ch.outgoing {
+		return ch.peer
+	}
+	if port := ch.listenPort(); port != 0 {
+		return Peer{IP: ch.peer.IP, Port: uint16(port)}
+	}
+	return ch.peer
+}
+
+// Send message of the named extension, peer has to support it.
+func (ch *Channel) sendExtended(name string, payload []byte) error {
+	id, ok := ch.remoteExtensionID(name)
+	if !ok {
+		return fmt.Errorf("peer %s does not support %s", ch.peer, name)
+	}
+	return ch.send(createExtendedMessage(id, payload))
+}
+
+// Process EXTENDED message not consumed by a specific extension.
+//
+// Updates the registry on extended handshake, serves ut_metadata
+// requests and collects ut_pex peers.
+func (ch *Channel) handleExtendedMessage(msg *Message) error {
+	id, payload, err := readExtendedMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	if id == extendedHandshakeID {
+		hs, err := readExtendedHandshake(payload)
+		if err != nil {
+			return err
+		}
+		ch.mu.Lock()
+		ch.extensions.update(hs)
+		ch.ExtendedHandshake = hs
+		ch.mu.Unlock()
+		return nil
+	}
+
+	name, ok := ch.extensions.localName(id)
+	if !ok {
+		return nil
+	}
+	switch name {
+	case "ut_metadata":
+		req, _, err := readMetadataMessage(payload)
+		if err != nil {
+			return err
+		}
+		if req.MsgType == metadataRequest {
+			return ch.serveMetadataRequest(req.Piece)
+		}
+	case "ut_pex":
+		return ch.handlePex(payload)
+	}
+	return nil
+}
+
+func (ch *Channel) hasPiece(index int) bool {
+	return ch.Bitfield.hasPiece(index)
+}
+
+// Cancel request of the block, e.g. after another peer delivered it.
+func (ch *Channel) cancelBlock(index, begin, length int) {
+	ch.sendCancel(index, begin, length)
+}
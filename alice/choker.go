@@ -0,0 +1,117 @@
+package alice
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Peers are rechoked every 10 seconds and the optimistic unchoke is
+// rotated every 30 seconds.
+const (
+	rechokeInterval    = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+)
+
+// Decide which peers are allowed to download from us (tit-for-tat).
+//
+// Interested peers we download from the fastest (we upload to the fastest
+// when seeding) get UploadSlots unchoked slots. One additional interested
+// peer is unchoked optimistically to discover peers with better rates.
+//
+// Newly interested peers trigger an early rechoke so that free slots are
+// not left unused until the next round. Choker stops with OutputToFile.
+func (t *Torrent) runChoker() {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+
+	var optimistic *Channel
+	var rotated time.Time
+	for {
+		rotate := time.Since(rotated) >= optimisticInterval
+		if rotate {
+			rotated = time.Now()
+		}
+		optimistic = t.rechoke(optimistic, rotate)
+
+		select {
+		case <-ticker.C:
+		case <-t.rechokeNow:
+		case <-t.stopping:
+			return
+		}
+	}
+}
+
+// Ask the choker to rechoke before the next round.
+func (t *Torrent) requestRechoke() {
+	select {
+	case t.rechokeNow <- struct{}{}:
+	default:
+	}
+}
+
+// Choke and unchoke peers, returns the optimistically unchoked peer.
+func (t *Torrent) rechoke(optimistic *Channel, rotate bool) *Channel {
+	t.mu.RLock()
+	channels := make([]*Channel, 0, len(t.channels))
+	for ch := range t.channels {
+		channels = append(channels, ch)
+	}
+	t.mu.RUnlock()
+
+	seeding := false
+	select {
+	case <-t.picker.finished():
+		seeding = true
+	default:
+	}
+
+	rates := make(map[*Channel]float64, len(channels))
+	var interested []*Channel
+	for _, ch := range channels {
+		if !ch.isInterested() {
+			continue
+		}
+		interested = append(interested, ch)
+		if seeding {
+			rates[ch] = ch.uploadRate.value()
+		} else {
+			rates[ch] = ch.downloadRate()
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	unchoke := make(map[*Channel]bool)
+	for i := 0; i < len(interested) && i < t.config.UploadSlots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	// keep optimistic unchoke until it is rotated or gone
+	if _, ok := rates[optimistic]; !ok || rotate {
+		optimistic = nil
+		var candidates []*Channel
+		for _, ch := range interested {
+			if !unchoke[ch] {
+				candidates = append(candidates, ch)
+			}
+		}
+		if len(candidates) > 0 {
+			optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+
+	for _, ch := range channels {
+		if unchoke[ch] {
+			ch.sendUnchoke()
+		} else {
+			ch.sendChoke()
+		}
+	}
+	return optimistic
+}
@@ -5,18 +5,42 @@ import "fmt"
 type Config struct {
 	UseTrackers          bool
 	UseDHT               bool
+	UseLSD               bool // local service discovery on the local network
 	ShowDownloadProgress bool
+	NewStorage           StorageFunc // NewFileStorage or NewMemoryStorage
+	ListenPort           int         // port for incoming connections, 0 disables
+	UseResumeFile        bool        // skip rehashing unchanged data on startup
+	UploadSlots          int         // peers unchoked besides the optimistic unchoke
+	UseWebSeeds          bool        // download from url-list and httpseeds servers (BEP 19, 17)
 }
 
 var DefaultConfig = Config{
 	UseTrackers:          true,
 	UseDHT:               true,
+	UseLSD:               true,
 	ShowDownloadProgress: true,
+	NewStorage:           NewFileStorage,
+	ListenPort:           6881,
+	UseResumeFile:        true,
+	UploadSlots:          4,
+	UseWebSeeds:          true,
 }
 
 func NewConfig(config Config) error {
-	if !config.UseTrackers && !config.UseDHT {
-		err := fmt.Errorf("enable tracker or dht peer discovery")
+	if !config.UseTrackers && !config.UseDHT && !config.UseLSD {
+		err := fmt.Errorf("enable tracker, dht or lsd peer discovery")
+		return err
+	}
+	if config.NewStorage == nil {
+		err := fmt.Errorf("provide storage for downloaded data")
+		return err
+	}
+	if config.ListenPort < 0 || config.ListenPort > 65535 {
+		err := fmt.Errorf("invalid listen port %d", config.ListenPort)
+		return err
+	}
+	if config.UploadSlots < 0 {
+		err := fmt.Errorf("invalid number of upload slots %d", config.UploadSlots)
 		return err
 	}
 	DefaultConfig = config
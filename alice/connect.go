@@ -18,7 +18,7 @@ func newConnect() *Connect {
 	transactionID := generateRandomID(4)
 	return &Connect{
 		ProtocolID:    0x41727101980,
-		Action:        0,
+		Action:        actionConnect,
 		TransactionID: transactionID,
 	}
 }
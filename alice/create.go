@@ -0,0 +1,226 @@
+package alice
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Piece length is chosen so that torrents have around 1500 pieces, within
+// 16kB and 16MB.
+const (
+	minPieceLength    = 16 * 1024
+	maxPieceLength    = 16 * 1024 * 1024
+	targetPieceNumber = 1500
+)
+
+// Options of a created torrent, only the input path is required.
+type CreateOptions struct {
+	AnnounceList [][]string // tiers of trackers, first tracker is also announce
+	PieceLength  int        // power of two, chosen by the size of data if 0
+	Private      bool       // peers only come from trackers (BEP 27)
+	Source       string     // makes info hash unique to the source (e.g. tracker)
+	Comment      string
+	CreatedBy    string    // client name, alice if empty
+	CreationDate time.Time // current time if zero
+	URLList      []string  // web seeds (BEP 19)
+}
+
+// Choose piece length for data of the given length.
+func choosePieceLength(length int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieceNumber {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// List files of the input path in lexical order.
+//
+// Single file results in one FileInfo without a path, directories list
+// their regular files relative to the directory.
+func listFiles(inputPath string) ([]FileInfo, error) {
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []FileInfo{{Length: int(info.Size())}}, nil
+	}
+
+	var files []FileInfo
+	offset := 0
+	err = filepath.Walk(inputPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(inputPath, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			Length: int(info.Size()),
+			Offset: offset,
+		})
+		offset += int(info.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		err := fmt.Errorf("directory %s has no files", inputPath)
+		return nil, err
+	}
+	return files, nil
+}
+
+// Hash pieces of the data in parallel.
+func hashPieces(storage Storage, tf *TorrentFile) ([][20]byte, error) {
+	numPieces := (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+	hashes := make([][20]byte, numPieces)
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				begin, end := calcPieceBounds(tf, index)
+				buf := make([]byte, end-begin)
+				_, err := storage.ReadAt(buf, index, 0)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				hashes[index] = sha1.Sum(buf)
+			}
+		}()
+	}
+
+	for index := 0; index < numPieces; index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return hashes, firstErr
+}
+
+// Create .torrent file at torrentPath describing the file or directory at
+// inputPath. Torrent is named after the base name of inputPath.
+func CreateTorrent(inputPath, torrentPath string, opts CreateOptions) (*TorrentFile, error) {
+	inputPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := listFiles(inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := TorrentFile{
+		Name:        filepath.Base(inputPath),
+		Files:       files,
+		PieceLength: opts.PieceLength,
+	}
+	for _, f := range files {
+		tf.Length += f.Length
+	}
+	if tf.Length == 0 {
+		err := fmt.Errorf("%s has no data", inputPath)
+		return nil, err
+	}
+	if tf.PieceLength == 0 {
+		tf.PieceLength = choosePieceLength(tf.Length)
+	}
+	if tf.PieceLength < 0 || tf.PieceLength&(tf.PieceLength-1) != 0 {
+		err := fmt.Errorf("piece length %d is not a power of two", tf.PieceLength)
+		return nil, err
+	}
+
+	// multi-file data lives in a directory named after the torrent
+	dataPath := inputPath
+	if tf.isMultiFile() {
+		dataPath = filepath.Dir(inputPath)
+	}
+	storage := newReadOnlyFileStorage(&tf, dataPath)
+	hashes, err := hashPieces(storage, &tf)
+	storage.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	bto := bencodeTorrent{
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		URLList:   opts.URLList,
+		Info: bencodeInfo{
+			PieceLength: tf.PieceLength,
+			Name:        tf.Name,
+			Source:      opts.Source,
+		},
+	}
+	for _, hash := range hashes {
+		bto.Info.Pieces += string(hash[:])
+	}
+	if tf.isMultiFile() {
+		for _, f := range files {
+			bto.Info.Files = append(bto.Info.Files, bencodeFileInfo{Length: f.Length, Path: f.Path})
+		}
+	} else {
+		bto.Info.Length = tf.Length
+	}
+	if opts.Private {
+		bto.Info.Private = 1
+	}
+	if bto.CreatedBy == "" {
+		bto.CreatedBy = clientVersion
+	}
+	bto.CreationDate = opts.CreationDate.Unix()
+	if opts.CreationDate.IsZero() {
+		bto.CreationDate = time.Now().Unix()
+	}
+
+	// announce-list is only needed for more than one tracker
+	var trackers []string
+	for _, tier := range opts.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+	if len(trackers) > 0 {
+		bto.Announce = trackers[0]
+	}
+	if len(trackers) > 1 {
+		bto.AnnounceList = opts.AnnounceList
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, bto)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(torrentPath, buf.Bytes(), 0644)
+	if err != nil {
+		return nil, err
+	}
+	return parseTorrent(buf.Bytes())
+}
@@ -1,106 +1,211 @@
 package alice
 
 import (
-	"bytes"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jackpal/bencode-go"
 	"github.com/nictuku/dht"
 )
 
-// GET request to tracker URL returns:
-//   - interval (time to send GET request for list of peers again)
-//   - peers (list of peers)
-type httpTrackerResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+// Announce events, numbered as in UDP tracker protocol.
+const (
+	eventNone      = 0
+	eventCompleted = 1
+	eventStarted   = 2
+	eventStopped   = 3
+)
+
+// Announce interval used if the tracker does not send one.
+const defaultAnnounceInterval = 30 * time.Minute
+
+var eventNames = map[int]string{
+	eventCompleted: "completed",
+	eventStarted:   "started",
+	eventStopped:   "stopped",
 }
 
-func httpRequestPeers(url string) ([]Peer, int, error) {
-	// get the response
-	conn := &http.Client{Timeout: 5 * time.Second}
-	response, err := conn.Get(url)
-	if err != nil {
-		return nil, 0, err
+// Announce parameters common to HTTP and UDP trackers.
+type trackerRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      int
+	TrackerID  string // HTTP only, tracker id of previous response
+	Key        []byte // UDP only, identifies the client across IP changes
+}
+
+// Tracker rejected the announce with a failure reason.
+type TrackerError struct {
+	Tracker string
+	Reason  string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker %s failed: %s", e.Tracker, e.Reason)
+}
+
+// Announce response common to HTTP and UDP trackers.
+type trackerResponse struct {
+	Peers       []Peer
+	Interval    int    // seconds until next announce
+	MinInterval int    // announcing more often is not allowed, 0 if unknown
+	TrackerID   string // has to be sent back on subsequent announces
+	Complete    int    // seeders
+	Incomplete  int    // leechers
+	Warning     string
+}
+
+// GET request to tracker URL returns a dictionary with:
+//   - failure reason (announce failed, no other keys are present)
+//   - warning message (announce succeeded despite the warning)
+//   - interval and min interval (time until next announce)
+//   - tracker id (echoed on subsequent announces)
+//   - complete and incomplete (number of seeders and leechers)
+//   - peers (compact string or list of dictionaries)
+//   - peers6 (compact string of IPv6 peers)
+//
+// The response is decoded generically since peers come in two formats.
+func readHTTPTrackerResponse(tracker string, data interface{}) (*trackerResponse, error) {
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		err := fmt.Errorf("tracker %s sent invalid response", tracker)
+		return nil, err
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, &TrackerError{Tracker: tracker, Reason: reason}
 	}
-	defer response.Body.Close()
 
-	// fill body of the response into Peer struct
-	trackerResponse := httpTrackerResponse{}
-	err = bencode.Unmarshal(response.Body, &trackerResponse)
-	if err != nil {
-		return nil, 0, err
+	res := trackerResponse{
+		Interval:    dictInt(dict, "interval"),
+		MinInterval: dictInt(dict, "min interval"),
+		TrackerID:   dictString(dict, "tracker id"),
+		Complete:    dictInt(dict, "complete"),
+		Incomplete:  dictInt(dict, "incomplete"),
+		Warning:     dictString(dict, "warning message"),
 	}
 
-	peers, err := Unmarshal([]byte(trackerResponse.Peers))
-	if err != nil {
-		return nil, 0, err
+	switch peers := dict["peers"].(type) {
+	case string:
+		// compact format
+		compact, err := Unmarshal([]byte(peers))
+		if err != nil {
+			return nil, err
+		}
+		res.Peers = compact
+	case []interface{}:
+		// dictionary format: peer id, ip and port of each peer
+		for _, p := range peers {
+			peer, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip := net.ParseIP(dictString(peer, "ip"))
+			port := dictInt(peer, "port")
+			if ip == nil || port <= 0 || port > 65535 {
+				continue
+			}
+			res.Peers = append(res.Peers, Peer{IP: ip, Port: uint16(port)})
+		}
 	}
-	return peers, trackerResponse.Interval, nil
+
+	if peers6, ok := dict["peers6"].(string); ok {
+		compact, err := Unmarshal6([]byte(peers6))
+		if err != nil {
+			return nil, err
+		}
+		res.Peers = append(res.Peers, compact...)
+	}
+	return &res, nil
 }
 
-func udpRequestPeers(url string, infoHash, peerID [20]byte, length int) ([]Peer, int, error) {
-	raddr, err := net.ResolveUDPAddr("udp", url)
-	if err != nil {
-		return nil, 0, err
+func httpRequestPeers(base *url.URL, req *trackerRequest) (*trackerResponse, error) {
+	// keep parameters of the announce URL such as passkeys
+	params := base.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))
+	params.Set("peer_id", string(req.PeerID[:]))
+	params.Set("port", strconv.Itoa(req.Port))
+	params.Set("uploaded", strconv.Itoa(req.Uploaded))
+	params.Set("downloaded", strconv.Itoa(req.Downloaded))
+	params.Set("compact", "1")
+	params.Set("left", strconv.Itoa(req.Left))
+	if event, ok := eventNames[req.Event]; ok {
+		params.Set("event", event)
 	}
-	conn, err := net.DialUDP("udp", nil, raddr)
-	if err != nil {
-		return nil, 0, err
+	if req.TrackerID != "" {
+		params.Set("trackerid", req.TrackerID)
+	}
+	if ip := localIPv6(); ip != nil {
+		// tracker might only see the IPv4 address otherwise
+		params.Set("ipv6", ip.String())
 	}
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+	u := *base
+	u.RawQuery = params.Encode()
 
-	connectReq := newConnect()
-	_, err = conn.Write(connectReq.serializeConnect())
+	// get the response
+	conn := &http.Client{Timeout: 5 * time.Second}
+	response, err := conn.Get(u.String())
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	connectBuf := make([]byte, 16)
-	_, err = conn.Read(connectBuf)
+	defer response.Body.Close()
+
+	data, err := bencode.Decode(response.Body)
 	if err != nil {
-		return nil, 0, err
-	}
-	connectRes := readConnect(connectBuf)
-	if !bytes.Equal(connectReq.TransactionID[:], connectRes.TransactionID[:]) {
-		err := fmt.Errorf("expected TID %s received %s", connectReq.TransactionID, connectRes.TransactionID)
-		return nil, 0, err
-	}
-	if connectRes.Action != 0 {
-		err := fmt.Errorf("expected action %d (connect) received %d", 0, connectRes.Action)
-		return nil, 0, err
+		return nil, err
 	}
+	return readHTTPTrackerResponse(base.Host, data)
+}
 
-	announceReq := newAnnounce(infoHash, peerID, length, connectRes.ConnectionID)
-	_, err = conn.Write(announceReq.serializeAnnounce())
+func udpRequestPeers(host string, req *trackerRequest) (*trackerResponse, error) {
+	ut, err := dialUDPTracker(host)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	announceBuf := make([]byte, 2048)
-	size, err := conn.Read(announceBuf)
+	defer ut.close()
+
+	buf, err := ut.request(maxAnnounceRetransmits, func(connectionID []byte) ([]byte, []byte) {
+		announceReq := newAnnounce(req, connectionID)
+		return announceReq.serializeAnnounce(), announceReq.TransactionID
+	})
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	announceRes := readAnnounce(announceBuf[:size])
-	if !bytes.Equal(announceReq.TransactionID[:], announceRes.TransactionID[:]) {
-		err := fmt.Errorf("expected TID %s received %s", announceReq.TransactionID, announceRes.TransactionID)
-		return nil, 0, err
+	if len(buf) < 20 {
+		err := fmt.Errorf("received invalid announce response of length %d", len(buf))
+		return nil, err
 	}
-	if announceRes.Action != 1 {
-		err := fmt.Errorf("expected action %d (announce) received %d", 1, announceRes.Action)
-		return nil, 0, err
+	announceRes := readAnnounce(buf)
+	if announceRes.Action != actionAnnounce {
+		err := fmt.Errorf("expected action %d (announce) received %d", actionAnnounce, announceRes.Action)
+		return nil, err
 	}
 
-	peers, err := Unmarshal([]byte(announceRes.Peers))
+	// trackers reached over IPv6 respond with IPv6 peers
+	unmarshal := Unmarshal
+	if ut.isIPv6() {
+		unmarshal = Unmarshal6
+	}
+	peers, err := unmarshal([]byte(announceRes.Peers))
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	return peers, int(announceRes.Interval), nil
+	res := trackerResponse{
+		Peers:      peers,
+		Interval:   int(announceRes.Interval),
+		Complete:   int(announceRes.Seeders),
+		Incomplete: int(announceRes.Leechers),
+	}
+	return &res, nil
 }
 
 func drainResults(n *dht.DHT, peersChannel chan []Peer) {
@@ -114,9 +219,24 @@ func drainResults(n *dht.DHT, peersChannel chan []Peer) {
 }
 
 // Get list of peers using DHT.
-func requestDHTPeers(tf *TorrentFile, peers chan []Peer) error {
-	ih := dht.InfoHash(string(tf.InfoHash[:]))
-	d, err := dht.New(nil)
+//
+// IPv6 DHT is joined as well if this host has a global IPv6 address.
+func requestDHTPeers(tf *TorrentFile, port int, peers chan []Peer) error {
+	err := startDHT(tf, port, peers, dht.NewConfig())
+	if err != nil {
+		return err
+	}
+	if localIPv6() != nil {
+		config := dht.NewConfig()
+		config.UDPProto = "udp6"
+		config.SaveRoutingTable = false
+		startDHT(tf, port, peers, config)
+	}
+	return nil
+}
+
+func startDHT(tf *TorrentFile, port int, peers chan []Peer, config *dht.Config) error {
+	d, err := dht.New(config)
 	if err != nil {
 		return err
 	}
@@ -126,75 +246,299 @@ func requestDHTPeers(tf *TorrentFile, peers chan []Peer) error {
 	go drainResults(d, peers)
 	go func() {
 		for {
-			d.PeersRequest(string(ih), false)
+			// announce ourselves only if incoming connections are accepted
+			for _, infoHash := range tf.infoHashes() {
+				d.PeersRequestPort(string(infoHash[:]), port != 0, port)
+			}
 			time.Sleep(5 * time.Second)
 		}
 	}()
 	return nil
 }
 
-// Get list of peers from the tracker.
-func requestTrackerPeers(tf *TorrentFile, peerID [20]byte, peersChannel chan []Peer) {
-	var announceList []string
+// Announce to a single tracker.
+func announceTracker(announce string, req *trackerRequest) (*trackerResponse, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch base.Scheme {
+	case "http", "https":
+		return httpRequestPeers(base, req)
+	case "udp":
+		return udpRequestPeers(base.Host, req)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+}
+
+// Announce every info hash of the torrent to the tracker, hybrid torrents
+// are in two swarms. Peers of all responses are merged.
+func (t *Torrent) announceTorrent(announce string, event int) (*trackerResponse, error) {
+	var merged *trackerResponse
+	var firstErr error
+	for _, infoHash := range t.metainfo().infoHashes() {
+		res, err := announceTracker(announce, t.newTrackerRequest(announce, infoHash, event))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if merged == nil {
+			merged = res
+			continue
+		}
+		merged.Peers = append(merged.Peers, res.Peers...)
+	}
+	if merged == nil {
+		return nil, firstErr
+	}
+	return merged, nil
+}
+
+func (t *Torrent) newTrackerRequest(announce string, infoHash [20]byte, event int) *trackerRequest {
+	uploaded, downloaded, left := t.stats()
+	t.mu.RLock()
+	trackerID := t.trackerIDs[announce]
+	t.mu.RUnlock()
+	return &trackerRequest{
+		InfoHash:   infoHash,
+		PeerID:     t.peerID,
+		Port:       t.port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Event:      event,
+		TrackerID:  trackerID,
+		Key:        t.key,
+	}
+}
+
+// Remember tracker id of the response and report tracker warnings.
+func (t *Torrent) trackerResponded(announce string, res *trackerResponse) {
+	if res.Warning != "" {
+		log.Printf("tracker %s warning: %s", announce, res.Warning)
+	}
+	if res.TrackerID == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.trackerIDs[announce] = res.TrackerID
+}
+
+// Check if tracker was sent the started event.
+func (t *Torrent) isAnnounced(announce string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, a := range t.announced {
+		if a == announce {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Torrent) setAnnounced(announce string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.announced = append(t.announced, announce)
+}
+
+// Copy of tracker tiers, a single tier with the announce URL if the
+// torrent has no announce-list.
+func (t *Torrent) announceTiers() [][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tf := t.torrentFile
 	if tf.AnnounceList == nil {
-		announceList = append(announceList, tf.Announce)
-	} else {
-		announceList = tf.AnnounceList
+		if tf.Announce == "" {
+			return nil
+		}
+		return [][]string{{tf.Announce}}
+	}
+	tiers := make([][]string, len(tf.AnnounceList))
+	for i, tier := range tf.AnnounceList {
+		tiers[i] = append([]string(nil), tier...)
+	}
+	return tiers
+}
+
+// Move tracker that responded to the front of its tier.
+func (t *Torrent) promoteTracker(tier int, announce string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tier >= len(t.torrentFile.AnnounceList) {
+		return
+	}
+	trackers := t.torrentFile.AnnounceList[tier]
+	for i, a := range trackers {
+		if a == announce {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = announce
+			return
+		}
 	}
-	trackerInterval := time.Duration(1)
+}
+
+// Get list of peers from the tracker.
+//
+// Tiers are tried in order and trackers within a tier in order until one
+// responds, which is then moved to the front of its tier (BEP 12). If no
+// tracker responds, announcing is retried with increasing delay.
+//
+// First announce to a tracker carries the started event. Completion of
+// the download is announced by Download itself. Announcing stops once
+// OutputToFile is called so that stopped is the last event trackers get.
+func (t *Torrent) requestTrackerPeers() {
+	t.trackersDone = make(chan struct{})
 	go func() {
-	Loop:
-		ticker := time.NewTicker(trackerInterval * time.Second)
+		defer close(t.trackersDone)
+		delay := time.Second
+		failures := 0
+		minInterval := 0
 		for {
 			select {
-			case <-ticker.C:
-				for _, announce := range announceList {
-					base, err := url.Parse(announce)
-					if err != nil {
-						continue
-					}
-					switch base.Scheme {
-					case "http", "https":
-						params := url.Values{
-							"info_hash":  []string{string(tf.InfoHash[:])},
-							"peer_id":    []string{string(peerID[:])},
-							"port":       []string{strconv.Itoa(0)},
-							"uploaded":   []string{"0"},
-							"downloaded": []string{"0"},
-							"compact":    []string{"1"},
-							"left":       []string{strconv.Itoa(tf.Length)},
-						}
-						base.RawQuery = params.Encode()
-						url := base.String()
-						peers, interval, err := httpRequestPeers(url)
-						if err != nil {
-							continue
-						}
-						peersChannel <- peers
-						announceList[0] = announce
-						trackerInterval = time.Duration(interval)
-						goto Loop
-					case "udp":
-						peers, interval, err := udpRequestPeers(base.Host, tf.InfoHash, peerID, tf.Length)
-						if err != nil {
-							continue
-						}
-						peersChannel <- peers
-						announceList[0] = announce
-						trackerInterval = time.Duration(interval)
-						goto Loop
-					}
+			case <-time.After(delay):
+			case <-t.stopping:
+				return
+			}
+
+			res := t.announceTiersOnce()
+			if res == nil {
+				delay = backoff(failures)
+				failures++
+			} else {
+				failures = 0
+				minInterval = res.MinInterval
+				delay = defaultAnnounceInterval
+				if res.Interval > 0 {
+					delay = time.Duration(res.Interval) * time.Second
+				}
+				// peers are no longer wanted once download returns
+				select {
+				case t.peers <- res.Peers:
+				case <-t.completed:
+				}
+			}
+			// retries must not be more frequent either
+			if min := time.Duration(minInterval) * time.Second; delay < min {
+				delay = min
+			}
+		}
+	}()
+}
+
+// Announce to trackers until one responds, nil if none does or announcing
+// was stopped.
+func (t *Torrent) announceTiersOnce() *trackerResponse {
+	for i, tier := range t.announceTiers() {
+		for _, announce := range tier {
+			select {
+			case <-t.stopping:
+				return nil
+			default:
+			}
+
+			started := t.isAnnounced(announce)
+			event := eventNone
+			if !started {
+				event = eventStarted
+			}
+			res, err := t.announceTorrent(announce, event)
+			if err != nil {
+				// unreachable trackers are expected, rejections are not
+				if te, ok := err.(*TrackerError); ok {
+					log.Printf("tracker %s failed: %s", announce, te.Reason)
 				}
+				continue
+			}
+			if !started {
+				t.setAnnounced(announce)
 			}
+			t.promoteTracker(i, announce)
+			t.trackerResponded(announce, res)
+			return res
 		}
+	}
+	return nil
+}
+
+// Send stopped event to every tracker that was sent the started event.
+//
+// Stopped is announced on shutdown and is therefore best effort.
+func (t *Torrent) announceStopped() {
+	// wait for announce in progress, it must not follow the stopped event
+	if t.trackersDone != nil {
+		select {
+		case <-t.trackersDone:
+		case <-time.After(udpTimeout):
+		}
+	}
+	t.announceEvent(eventStopped)
+}
+
+// Send completed event to every tracker that was sent the started event.
+func (t *Torrent) announceCompleted() {
+	t.announceEvent(eventCompleted)
+}
+
+// Send event to every tracker that was sent the started event.
+func (t *Torrent) announceEvent(event int) {
+	t.mu.RLock()
+	announced := append([]string(nil), t.announced...)
+	t.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, announce := range announced {
+		wg.Add(1)
+		go func(announce string) {
+			defer wg.Done()
+			t.announceTorrent(announce, event)
+		}(announce)
+	}
+
+	// unresponsive UDP trackers are not waited for until they time out
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(udpTimeout):
+	}
 }
 
-func (t *Torrent) DiscoverPeers() {
+// Start peer discovery and accept incoming connections.
+func (t *Torrent) DiscoverPeers() error {
+	// listen first so that the real port is announced
+	err := t.listen()
+	if err != nil {
+		return err
+	}
+
+	if len(t.initialPeers) > 0 {
+		go func() {
+			t.peers <- t.initialPeers
+		}()
+	}
 	if t.config.UseTrackers {
-		requestTrackerPeers(t.torrentFile, t.peerID, t.peers)
+		t.requestTrackerPeers()
 	}
-	if t.config.UseDHT {
-		requestDHTPeers(t.torrentFile, t.peers)
+	// private torrents only get peers from their trackers
+	private := t.torrentFile.Private
+	if t.config.UseDHT && !private {
+		err = requestDHTPeers(t.torrentFile, t.port, t.peers)
+		if err != nil {
+			return err
+		}
 	}
+	if t.config.UseLSD && !private {
+		err = t.requestLSDPeers()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
-	"log"
-	"os"
 	"strconv"
 	"time"
 
@@ -15,140 +13,170 @@ import (
 // data is downloaded in blocks (16kB) and not pieces
 const maxBlockSize = 16 * 1024
 
-const maxPipelineDepth = 25
-
-type download struct {
-	Index  int
-	Hash   [20]byte
-	Length int
-}
-
 type assemble struct {
 	Index  int
 	Buffer []byte
 }
 
-type pieceState struct {
-	index         int
-	channel       *Channel
-	buffer        []byte
-	downloaded    int
-	requested     int
-	pipelineDepth int
-}
+// Process message received while downloading.
+//
+// Blocks of any piece being downloaded are accepted, late blocks that are
+// no longer needed are ignored.
+func (t *Torrent) handleMessage(ch *Channel, msg *Message, assembleQueue chan *assemble) error {
+	if msg.ID != piece {
+		err := ch.handleMessage(msg)
+		if err != nil {
+			return err
+		}
+		return ch.serveUploads()
+	}
 
-func (ps *pieceState) readMessage() error {
-	msg, err := ps.channel.read()
+	index, begin, block, err := readPieceMessage(msg)
+	if err != nil {
+		return err
+	}
+	ch.pipeline.blockReceived(index, begin, len(block))
+	ch.lastBlock = time.Now()
+	// peer completing a corrupt piece is disconnected
+	err = t.receiveBlock(ch, index, begin, block, assembleQueue)
 	if err != nil {
 		return err
 	}
+	return ch.serveUploads()
+}
 
-	// keep-alive
-	if msg == nil {
+// Store block received from peer or web seed. Piece completed by the
+// block is checked and queued for assembly, an error is returned if it
+// fails the integrity check.
+func (t *Torrent) receiveBlock(src blockSource, index, begin int, block []byte, assembleQueue chan *assemble) error {
+	t.addDownloaded(len(block))
+	ps := t.picker.receiveBlock(src, index, begin, block)
+	if ps == nil {
 		return nil
 	}
 
-	switch msg.ID {
-	case unchoke:
-		ps.channel.Choked = false
-	case choke:
-		ps.channel.Choked = true
-	case have:
-		index, err := readHaveMessage(msg)
-		if err != nil {
-			return err
-		}
-		ps.channel.Bitfield.setPiece(index)
-	case piece:
-		blockLen, err := readPieceMessage(ps.index, ps.buffer, msg)
-		if err != nil {
-			return err
+	err := t.torrentFile.checkPiece(ps.index, ps.buffer)
+	t.picker.finish(ps, err == nil)
+	if err == nil {
+		// piece is dropped if download returned, e.g. it was stopped
+		select {
+		case assembleQueue <- &assemble{ps.index, ps.buffer}:
+		case <-t.completed:
 		}
-		ps.downloaded += blockLen
-		ps.pipelineDepth--
 	}
-	return nil
+	return err
 }
 
-func downloadPiece(ch *Channel, d *download) ([]byte, error) {
-	state := pieceState{
-		index:   d.Index,
-		channel: ch,
-		buffer:  make([]byte, d.Length),
+func checkIntegrity(index int, expected [20]byte, buf []byte) error {
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], expected[:]) {
+		return fmt.Errorf("index %d failed integrity check", index)
 	}
+	return nil
+}
 
-	ch.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer ch.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < d.Length {
-		if !state.channel.Choked {
-			// do not exceed maximum pipeline depth and request at most the piece length
-			for state.pipelineDepth < maxPipelineDepth && state.requested < d.Length {
-				blockSize := maxBlockSize
-				// remaining block size might be smaller than 16kB
-				if d.Length-state.requested < blockSize {
-					blockSize = d.Length - state.requested
-				}
-
-				err := ch.sendRequest(d.Index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.pipelineDepth++
-				state.requested += blockSize
-			}
-		}
-
-		// check status between client and peer
-		// might get choked/unchoked/have/piece message
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+// Connect to peers that are not connected yet.
+func (t *Torrent) startDownloaders(peers []Peer, assembleQueue chan *assemble) {
+	for _, peer := range peers {
+		if t.isConnected(peer) {
+			continue
 		}
+		go t.startDownloader(peer, assembleQueue)
 	}
-
-	return state.buffer, nil
 }
 
-func checkIntegrity(d *download, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], d.Hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", d.Index)
+func (t *Torrent) startDownloader(peer Peer, assembleQueue chan *assemble) {
+	ch, err := t.connect(peer)
+	if err != nil {
+		return
 	}
-	return nil
+	t.runDownloader(ch, assembleQueue)
 }
 
-func (t *Torrent) startDownloader(peer Peer, downloadQueue chan *download, assembleQueue chan *assemble) {
-	ch, err := t.newChannel(peer, t.peerID, t.torrentFile.InfoHash)
-	if err != nil {
+// Download pieces over an established channel (dialed or accepted).
+func (t *Torrent) runDownloader(ch *Channel, assembleQueue chan *assemble) {
+	defer ch.close()
+
+	if !t.addChannel(ch) {
 		return
 	}
-	defer ch.Conn.Close()
+	defer t.removeChannel(ch)
+	go ch.readLoop()
+
+	t.picker.addPeer(ch.Bitfield)
+	ch.counted = true
+	defer t.picker.removePeer(ch)
 
-	ch.sendUnchoke()
 	ch.sendInterested()
 
-	for d := range downloadQueue {
-		if !ch.Bitfield.hasPiece(d.Index) {
-			downloadQueue <- d
-			continue
-		}
+	err := t.downloadPieces(ch, assembleQueue)
+	if err != nil {
+		return
+	}
 
-		buf, err := downloadPiece(ch, d)
-		if err != nil {
-			t.activePeers--
-			downloadQueue <- d
-			return
-		}
+	// keep serving peer after download finished
+	ch.sendNotInterested()
+	ch.serve()
+}
 
-		err = checkIntegrity(d, buf)
-		if err != nil {
-			downloadQueue <- d
-			continue
+// Request blocks picked for the peer until all pieces are completed.
+//
+// Peer that does not deliver any of its outstanding requests within 30
+// seconds is disconnected.
+func (t *Torrent) downloadPieces(ch *Channel, assembleQueue chan *assemble) error {
+	keepAlive := time.NewTicker(2 * time.Minute)
+	defer keepAlive.Stop()
+	snubCheck := time.NewTicker(5 * time.Second)
+	defer snubCheck.Stop()
+
+	for {
+		if !ch.Choked {
+			// keep pipeline of the peer full
+			for t.picker.requests(ch) < ch.pipelineDepth() {
+				block, ok := t.picker.request(ch)
+				if !ok {
+					break
+				}
+				if t.picker.requests(ch) == 1 {
+					ch.lastBlock = time.Now()
+				}
+				err := ch.sendRequest(block.index, block.begin, block.length)
+				if err != nil {
+					return err
+				}
+				ch.pipeline.requestSent(block.index, block.begin)
+			}
 		}
 
-		ch.sendHave(d.Index)
-		assembleQueue <- &assemble{d.Index, buf}
+		// check status between client and peer
+		// might get choked/unchoked/have/piece message
+		select {
+		case msg, ok := <-ch.messages:
+			if !ok {
+				return ch.readErr
+			}
+			err := t.handleMessage(ch, msg, assembleQueue)
+			if err != nil {
+				return err
+			}
+			if ch.Choked {
+				// choked peer discards requests
+				t.picker.dropRequests(ch)
+				ch.pipeline.forgetAll()
+			}
+		case <-t.picker.wakeup():
+		case <-t.picker.finished():
+			return nil
+		case <-snubCheck.C:
+			if t.picker.requests(ch) > 0 && time.Since(ch.lastBlock) > 30*time.Second {
+				return fmt.Errorf("peer %s did not send requested blocks", ch.peer)
+			}
+		case <-keepAlive.C:
+			err := ch.sendKeepAlive()
+			if err != nil {
+				return err
+			}
+		}
 	}
 }
 
@@ -168,10 +196,11 @@ func (t *Torrent) calcPieceSize(index int) int {
 
 func (t *Torrent) downloadProgress() *uiprogress.Bar {
 	uiprogress.Start()
-	bar := uiprogress.AddBar(len(t.torrentFile.PieceHashes))
+	bar := uiprogress.AddBar(t.torrentFile.numPieces())
+	bar.Set(t.piecesDone)
 	bar.AppendCompleted()
 	bar.AppendFunc(func(b *uiprogress.Bar) string {
-		return "pieces: " + strconv.Itoa(t.piecesDone) + "/" + strconv.Itoa(len(t.torrentFile.PieceHashes))
+		return "pieces: " + strconv.Itoa(t.piecesDone) + "/" + strconv.Itoa(t.torrentFile.numPieces())
 	})
 	bar.AppendFunc(func(b *uiprogress.Bar) string {
 		return "peers: " + strconv.Itoa(t.activePeers)
@@ -180,52 +209,128 @@ func (t *Torrent) downloadProgress() *uiprogress.Bar {
 	return bar
 }
 
-func (t *Torrent) assemblePieces(assembleQueue chan *assemble, downloadQueue chan *download) {
+// Write verified pieces to storage until all pieces are completed or the
+// download is stopped.
+func (t *Torrent) assemblePieces(assembleQueue chan *assemble) error {
 	var progressBar *uiprogress.Bar
 	if t.config.ShowDownloadProgress {
 		progressBar = t.downloadProgress()
 	}
-	t.outputBuffer = make([]byte, t.torrentFile.Length)
-	for t.piecesDone < len(t.torrentFile.PieceHashes) {
-		res := <-assembleQueue
-		begin, end := calcPieceBounds(t.torrentFile, res.Index)
-		copy(t.outputBuffer[begin:end], res.Buffer)
+	lastSave := time.Now()
+Assemble:
+	for t.piecesDone < t.torrentFile.numPieces() {
+		var res *assemble
+		select {
+		case res = <-assembleQueue:
+		case <-t.stopping:
+			break Assemble
+		}
+		_, err := t.storage.WriteAt(res.Buffer, res.Index, 0)
+		if err != nil {
+			return err
+		}
+		err = t.storage.MarkComplete(res.Index)
+		if err != nil {
+			return err
+		}
+		t.completePiece(res.Index)
+		t.picker.complete(res.Index)
 		t.piecesDone++
 		if progressBar != nil {
 			progressBar.Incr()
 		}
+		if time.Since(lastSave) > 30*time.Second {
+			t.saveResume()
+			lastSave = time.Now()
+		}
 	}
+	t.saveResume()
 	if progressBar != nil {
 		uiprogress.Stop()
 	}
-	close(downloadQueue)
-	t.finishedDownload = true
+	if t.piecesDone == t.torrentFile.numPieces() {
+		t.finishedDownload = true
+	}
+	return nil
 }
 
-func (t *Torrent) Download() {
-	downloadQueue := make(chan *download, len(t.torrentFile.PieceHashes))
+func (t *Torrent) Download() error {
+	defer close(t.completed)
+
+	storage, err := t.config.NewStorage(t.torrentFile, t.outputPath)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.storage = storage
+	t.bitfield = make(Bitfield, (t.torrentFile.numPieces()+7)/8)
+	t.mu.Unlock()
+
+	// only download pieces missing from existing data
+	err = t.verifyPieces()
+	if err != nil {
+		return err
+	}
+	t.picker = newPiecePicker(t.torrentFile, t.bitfield)
+	go t.runChoker()
+	if !t.torrentFile.Private {
+		go t.runPex()
+	}
+	if t.piecesDone == t.torrentFile.numPieces() {
+		t.finishedDownload = true
+		return nil
+	}
+
 	assembleQueue := make(chan *assemble)
-	for index, hash := range t.torrentFile.PieceHashes {
-		length := t.calcPieceSize(index)
-		downloadQueue <- &download{Index: index, Hash: hash, Length: length}
-	}
-	go t.assemblePieces(assembleQueue, downloadQueue)
-	for !t.finishedDownload {
-		for _, peer := range <-t.peers {
-			go t.startDownloader(peer, downloadQueue, assembleQueue)
+	assembled := make(chan error, 1)
+	go func() {
+		assembled <- t.assemblePieces(assembleQueue)
+	}()
+	if t.config.UseWebSeeds {
+		t.startWebSeeds(assembleQueue)
+	}
+	t.startDownloaders(t.metadataPeers, assembleQueue)
+	for {
+		select {
+		case peers := <-t.peers:
+			t.startDownloaders(peers, assembleQueue)
+		case ch := <-t.incoming:
+			go t.runDownloader(ch, assembleQueue)
+		case err := <-assembled:
+			if err != nil {
+				return err
+			}
+			if !t.finishedDownload {
+				// stopped by OutputToFile
+				return nil
+			}
+			t.announceCompleted()
+			return nil
 		}
 	}
 }
 
-func (t *Torrent) OutputToFile() {
-	outFile, err := os.Create(t.outputPath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer outFile.Close()
+// Stop the download if it is still running, disconnect peers, flush
+// downloaded data, release the storage and tell trackers that the client
+// stopped.
+//
+// Has to be called once Download was started, even if it failed.
+func (t *Torrent) OutputToFile() error {
+	t.unlisten()
+	t.stopLSD()
+	close(t.stopping)
+	<-t.completed
+	t.closeChannels()
+	t.announceStopped()
 
-	_, err = outFile.Write(t.outputBuffer)
+	// storage is missing if it could not be created
+	if t.storage == nil {
+		return nil
+	}
+	err := t.saveResume()
+	closeErr := t.storage.Close()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return closeErr
 }
@@ -0,0 +1,172 @@
+package alice
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Extension protocol (BEP 10) support is advertised by setting the
+// 20th bit from the right (reserved[5] & 0x10) in the handshake.
+const extensionBit = 0x10
+
+// Extended message ID 0 is reserved for the extended handshake, other
+// IDs are assigned to extensions by the handshake itself.
+const extendedHandshakeID = 0
+
+// Client name and version sent in the extended handshake.
+const clientVersion = "alice"
+
+// Number of outstanding requests we allow peers to queue.
+const requestQueueSize = 250
+
+// Extensions supported by us together with the extended message IDs we
+// expect peers to use when sending them to us.
+var localExtensions = map[string]uint8{
+	"ut_metadata": localMetadataID,
+	"ut_pex":      localPexID,
+}
+
+// Sent as the first extended message after the handshake.
+//
+// Fields:
+//   - m (maps extension names to extended message IDs the sender expects)
+//   - v (client name and version)
+//   - reqq (number of outstanding requests the sender allows)
+//   - yourip (compact IP address of the receiver as seen by the sender)
+//   - p (local TCP listen port of the sender)
+//   - ipv6 (compact IPv6 address of the sender)
+//   - metadata_size (size of the info dictionary, see BEP 9)
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	IPv6         string         `bencode:"ipv6,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// Maps extension names to extended message IDs for both directions.
+type extensionRegistry struct {
+	local  map[string]uint8 // IDs peer uses when sending to us
+	remote map[string]uint8 // IDs we use when sending to peer
+}
+
+func newExtensionRegistry() extensionRegistry {
+	return extensionRegistry{
+		local:  localExtensions,
+		remote: make(map[string]uint8),
+	}
+}
+
+// Update IDs we have to use from the peer's extended handshake.
+//
+// Handshake can be sent more than once, extension with ID 0 is disabled.
+func (er *extensionRegistry) update(hs *ExtendedHandshake) {
+	for name, id := range hs.M {
+		if id <= 0 || id > 255 {
+			delete(er.remote, name)
+			continue
+		}
+		er.remote[name] = uint8(id)
+	}
+}
+
+// Return extended message ID to use when sending named extension to peer.
+func (er *extensionRegistry) remoteID(name string) (uint8, bool) {
+	id, ok := er.remote[name]
+	return id, ok
+}
+
+// Return name of the extension peer sent to us with the given ID.
+func (er *extensionRegistry) localName(id uint8) (string, bool) {
+	for name, localID := range er.local {
+		if localID == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Creates peer message with ID of 20 (EXTENDED).
+//
+// Format of the message: <length><id=20><extended id><payload>
+func createExtendedMessage(extendedID uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extendedID
+	copy(buf[1:], payload)
+	return &Message{ID: extended, Payload: buf}
+}
+
+// Extract extended ID and payload from raw EXTENDED message.
+func readExtendedMessage(msg *Message) (uint8, []byte, error) {
+	if msg.ID != extended {
+		return 0, nil, fmt.Errorf("expected ID of %d (EXTENDED), got ID %d", extended, msg.ID)
+	}
+
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("expected payload of length at least 1, got length 0")
+	}
+
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+func newExtendedHandshake(peer Peer, port int, tf *TorrentFile) *ExtendedHandshake {
+	m := make(map[string]int, len(localExtensions))
+	for name, id := range localExtensions {
+		// private torrents get peers from their trackers only (BEP 27)
+		if tf.Private && name == "ut_pex" {
+			continue
+		}
+		m[name] = int(id)
+	}
+
+	yourIP := peer.IP.To4()
+	if yourIP == nil {
+		yourIP = peer.IP.To16()
+	}
+
+	hs := ExtendedHandshake{
+		M:            m,
+		V:            clientVersion,
+		Reqq:         requestQueueSize,
+		YourIP:       string(yourIP),
+		P:            port,
+		MetadataSize: len(tf.RawInfo), // omitted until metadata is known
+	}
+	// let IPv4 peers know how to reach us over IPv6
+	if ip := localIPv6(); ip != nil {
+		hs.IPv6 = string(ip.To16())
+	}
+	return &hs
+}
+
+func createExtendedHandshake(hs *ExtendedHandshake) (*Message, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *hs)
+	if err != nil {
+		return nil, err
+	}
+	return createExtendedMessage(extendedHandshakeID, buf.Bytes()), nil
+}
+
+func readExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	hs := ExtendedHandshake{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &hs)
+	if err != nil {
+		return nil, err
+	}
+	return &hs, nil
+}
+
+// Return our IP address as seen by the peer (yourip), if sent.
+func (hs *ExtendedHandshake) ExternalIP() net.IP {
+	switch len(hs.YourIP) {
+	case net.IPv4len, net.IPv6len:
+		return net.IP(hs.YourIP)
+	}
+	return nil
+}
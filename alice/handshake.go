@@ -8,11 +8,12 @@ import (
 // Handshake string consists of (in order):
 //   - 1 byte for pstr length (length of protocal identifier - has to be 19)
 //   - 19 bytes for pstr (protocol identifier - BittorentProtocol)
-//   - 8 reserved bytes for extension support (no supported here)
+//   - 8 reserved bytes for extension support
 //   - 20 bytes for infohash (SHA-1 of bencoded metainfo file)
 //   - 20 bytes for peerID (random id to identify ourselves)
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -22,11 +23,13 @@ const handshakeLen = 68
 
 // Create new Handshake struct with given infoHash and peerID.
 func newHandshake(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[5] |= extensionBit
+	return &h
 }
 
 // Put together a handshake string.
@@ -35,7 +38,7 @@ func (h *Handshake) serializeHandshake() []byte {
 	buf[0] = byte(len(h.Pstr)) // len of pstr string in hex
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -60,14 +63,39 @@ func readHandshake(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
+	copy(reserved[:], handshakeBuf[pstrLen:pstrLen+8])
 	copy(infoHash[:], handshakeBuf[pstrLen+8:pstrLen+8+20])
 	copy(peerID[:], handshakeBuf[pstrLen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrLen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
 	return &h, nil
 }
+
+// Check if the extension protocol (BEP 10) bit is set.
+func (h *Handshake) supportsExtensions() bool {
+	return h.Reserved[5]&extensionBit != 0
+}
+
+// Reserved bit of peers supporting v2 torrents (BEP 52).
+const v2Bit = 0x10
+
+// Create handshake of the torrent, support of v2 is only announced for
+// v2 and hybrid torrents.
+func (t *Torrent) newHandshake(infoHash, peerID [20]byte) *Handshake {
+	h := newHandshake(infoHash, peerID)
+	if t.metainfo().hasV2() {
+		h.Reserved[7] |= v2Bit
+	}
+	return h
+}
+
+func (h *Handshake) supportsV2() bool {
+	return h.Reserved[7]&v2Bit != 0
+}
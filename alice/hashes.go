@@ -0,0 +1,152 @@
+package alice
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Peers send at most this many hashes of a layer per message (BEP 52).
+const maxHashesLength = 512
+
+// Hashes of a file merkle tree requested from peer.
+//
+// Index and length select nodes of the base layer (0 are the leaves),
+// proof layers is the number of layers above it to prove them with.
+type hashRange struct {
+	root        [32]byte
+	baseLayer   int
+	index       int
+	length      int
+	proofLayers int
+}
+
+// Creates HASH REQUEST, HASHES or HASH REJECT message.
+//
+// Format of the message: <id><pieces root><base layer><index><length>
+// <proof layers><hashes>, hashes are only sent with HASHES.
+func createHashMessage(id messageID, hr hashRange, list [][32]byte) *Message {
+	payload := make([]byte, 48+32*len(list))
+	copy(payload[0:32], hr.root[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(hr.baseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(hr.index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(hr.length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(hr.proofLayers))
+	for i, hash := range list {
+		copy(payload[48+32*i:], hash[:])
+	}
+	return &Message{ID: id, Payload: payload}
+}
+
+// Extract hash range and hashes from raw HASH REQUEST, HASHES or HASH
+// REJECT message.
+func readHashMessage(msg *Message) (hashRange, [][32]byte, error) {
+	var hr hashRange
+	if msg.ID != hashRequest && msg.ID != hashes && msg.ID != hashReject {
+		return hr, nil, fmt.Errorf("expected ID of %d, %d or %d (HASH REQUEST, HASHES, HASH REJECT), got ID %d", hashRequest, hashes, hashReject, msg.ID)
+	}
+	if len(msg.Payload) < 48 || (len(msg.Payload)-48)%32 != 0 {
+		return hr, nil, fmt.Errorf("received malformed hash message of length %d", len(msg.Payload))
+	}
+
+	copy(hr.root[:], msg.Payload[0:32])
+	hr.baseLayer = int(binary.BigEndian.Uint32(msg.Payload[32:36]))
+	hr.index = int(binary.BigEndian.Uint32(msg.Payload[36:40]))
+	hr.length = int(binary.BigEndian.Uint32(msg.Payload[40:44]))
+	hr.proofLayers = int(binary.BigEndian.Uint32(msg.Payload[44:48]))
+
+	list := make([][32]byte, (len(msg.Payload)-48)/32)
+	for i := range list {
+		copy(list[i][:], msg.Payload[48+32*i:])
+	}
+	return hr, list, nil
+}
+
+// Look up requested hashes together with their proof.
+//
+// Only piece layers are kept, requests for other layers are refused.
+func (tf *TorrentFile) lookupHashes(hr hashRange) ([][32]byte, bool) {
+	layer, ok := tf.PieceLayers[hr.root]
+	if !ok || hr.baseLayer != tf.pieceLayerHeight() {
+		return nil, false
+	}
+	numNodes := nextPowerOfTwo(len(layer))
+	if hr.length < 2 || hr.length > maxHashesLength || hr.length&(hr.length-1) != 0 {
+		return nil, false
+	}
+	if hr.index < 0 || hr.index%hr.length != 0 || hr.index+hr.length > numNodes {
+		return nil, false
+	}
+	pad := padHash(hr.baseLayer)
+	return merkleProof(layer, numNodes, pad, hr.index, hr.length, hr.proofLayers), true
+}
+
+// Answer HASH REQUEST message with HASHES or HASH REJECT.
+func (ch *Channel) serveHashRequest(msg *Message) error {
+	hr, _, err := readHashMessage(msg)
+	if err != nil {
+		return err
+	}
+	list, ok := ch.torrent.metainfo().lookupHashes(hr)
+	if !ok {
+		return ch.send(createHashMessage(hashReject, hr, nil))
+	}
+	return ch.send(createHashMessage(hashes, hr, list))
+}
+
+// Request piece layers missing from fetched metadata, every layer is
+// checked against the pieces root of its file.
+func (ch *Channel) requestPieceLayers(tf *TorrentFile) (map[[32]byte][][32]byte, error) {
+	layers := make(map[[32]byte][][32]byte)
+	pending := make(map[hashRange]struct{})
+	for _, f := range tf.Files {
+		if f.Padding || f.Length <= tf.PieceLength {
+			continue
+		}
+		if _, ok := layers[f.PiecesRoot]; ok {
+			// files with identical data share the layer
+			continue
+		}
+		numPieces := (f.Length + tf.PieceLength - 1) / tf.PieceLength
+		numNodes := nextPowerOfTwo(numPieces)
+		length := numNodes
+		if length > maxHashesLength {
+			length = maxHashesLength
+		}
+		layers[f.PiecesRoot] = make([][32]byte, numPieces)
+		for index := 0; index < numPieces; index += length {
+			hr := hashRange{f.PiecesRoot, tf.pieceLayerHeight(), index, length, log2(numNodes)}
+			err := ch.send(createHashMessage(hashRequest, hr, nil))
+			if err != nil {
+				return nil, err
+			}
+			pending[hr] = struct{}{}
+		}
+	}
+
+	for len(pending) > 0 {
+		msg, err := ch.read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || (msg.ID != hashes && msg.ID != hashReject) {
+			continue
+		}
+		hr, list, err := readHashMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := pending[hr]; !ok {
+			continue
+		}
+		if msg.ID == hashReject {
+			return nil, fmt.Errorf("peer %s rejected hash request", ch.peer)
+		}
+		if len(list) < hr.length || !verifyMerkleProof(list[:hr.length], hr.index, list[hr.length:], hr.root) {
+			return nil, fmt.Errorf("peer %s sent invalid hashes", ch.peer)
+		}
+		// hashes past the last piece only pad the layer
+		copy(layers[hr.root][hr.index:], list[:hr.length])
+		delete(pending, hr)
+	}
+	return layers, nil
+}
@@ -24,3 +24,32 @@ func generateRandomID(size int) []byte {
 	}
 	return transactionID
 }
+
+// Read integer from decoded bencode dictionary, 0 if missing.
+func dictInt(dict map[string]interface{}, key string) int {
+	value, _ := dict[key].(int64)
+	return int(value)
+}
+
+// Read string from decoded bencode dictionary, empty if missing.
+func dictString(dict map[string]interface{}, key string) string {
+	value, _ := dict[key].(string)
+	return value
+}
+
+// Read list of strings from decoded bencode dictionary, values that are
+// not strings are skipped.
+func dictStrings(dict map[string]interface{}, key string) []string {
+	list, _ := dict[key].([]interface{})
+	return stringList(list)
+}
+
+func stringList(list []interface{}) []string {
+	var values []string
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
@@ -0,0 +1,81 @@
+package alice
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Largest response body of a busy HTTP seed that is read for the delay.
+const maxRetryAfterBody = 64
+
+// Seed script serving pieces by index (BEP 17).
+//
+// Pieces are requested as <url>?info_hash=<info hash>&piece=<index>
+// &ranges=<begin>-<end> with an inclusive byte range within the piece.
+// Busy seeds respond with 503 and the number of seconds to wait as the
+// body.
+type httpSeed struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSeed(url string) *httpSeed {
+	return &httpSeed{
+		url:    url,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// HTTP seeds have the complete data.
+func (hs *httpSeed) hasPiece(index int) bool {
+	return true
+}
+
+// Requests of HTTP seeds cover whole pieces and are not canceled.
+func (hs *httpSeed) cancelBlock(index, begin, length int) {}
+
+func (hs *httpSeed) fetchPiece(tf *TorrentFile, index int) ([]byte, error) {
+	begin, end := calcPieceBounds(tf, index)
+
+	base, err := url.Parse(hs.url)
+	if err != nil {
+		return nil, err
+	}
+	params := base.Query()
+	params.Set("info_hash", string(tf.InfoHash[:]))
+	params.Set("piece", strconv.Itoa(index))
+	params.Set("ranges", fmt.Sprintf("0-%d", end-begin-1))
+	base.RawQuery = params.Encode()
+
+	res, err := hs.client.Get(base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusServiceUnavailable {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, maxRetryAfterBody))
+		delay, ok := parseRetryAfter(string(body))
+		if !ok {
+			delay, ok = parseRetryAfter(res.Header.Get("Retry-After"))
+		}
+		if ok {
+			return nil, &retryAfterError{hs.url, delay}
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("http seed %s responded with %s", hs.url, res.Status)
+		return nil, err
+	}
+
+	buf := make([]byte, end-begin)
+	_, err = io.ReadFull(res.Body, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
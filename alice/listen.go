@@ -0,0 +1,148 @@
+package alice
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Accepts incoming peer connections and routes them to torrents by the
+// info hash received in the handshake.
+type peerListener struct {
+	listener net.Listener
+	port     int
+	mu       sync.RWMutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Listeners shared by all torrents with the same listen port, started on
+// first use and closed once no torrent is registered anymore.
+var (
+	listenersMu sync.Mutex
+	listeners   = make(map[int]*peerListener)
+)
+
+// Start listening on the configured port unless another torrent already
+// does and register torrent so that incoming connections for it are
+// accepted.
+func (t *Torrent) listen() error {
+	if t.config.ListenPort == 0 {
+		return nil
+	}
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	pl, ok := listeners[t.config.ListenPort]
+	if !ok {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", t.config.ListenPort))
+		if err != nil {
+			err := fmt.Errorf("cannot listen on port %d: %s", t.config.ListenPort, err)
+			return err
+		}
+		pl = &peerListener{
+			listener: l,
+			port:     l.Addr().(*net.TCPAddr).Port,
+			torrents: make(map[[20]byte]*Torrent),
+		}
+		listeners[t.config.ListenPort] = pl
+		go pl.accept()
+	}
+
+	pl.mu.Lock()
+	for _, infoHash := range t.torrentFile.infoHashes() {
+		pl.torrents[infoHash] = t
+	}
+	pl.mu.Unlock()
+	t.listener = pl
+	t.port = pl.port
+	return nil
+}
+
+// Stop accepting incoming connections for the torrent, listener is closed
+// once it has no torrents left.
+func (t *Torrent) unlisten() {
+	if t.listener == nil {
+		return
+	}
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	pl := t.listener
+	pl.mu.Lock()
+	for infoHash, other := range pl.torrents {
+		if other == t {
+			delete(pl.torrents, infoHash)
+		}
+	}
+	empty := len(pl.torrents) == 0
+	pl.mu.Unlock()
+
+	if empty {
+		pl.listener.Close()
+		delete(listeners, t.config.ListenPort)
+	}
+	t.listener = nil
+}
+
+func (pl *peerListener) accept() {
+	for {
+		conn, err := pl.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(time.Second)
+				continue
+			}
+			return
+		}
+		go pl.handleConn(conn)
+	}
+}
+
+func (pl *peerListener) lookup(infoHash [20]byte) *Torrent {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return pl.torrents[infoHash]
+}
+
+// Complete handshake of the incoming connection and hand it over to the
+// torrent it belongs to.
+func (pl *peerListener) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	t := pl.lookup(request.InfoHash)
+	if t == nil || request.PeerID == t.peerID {
+		conn.Close()
+		return
+	}
+
+	response := t.newHandshake(request.InfoHash, t.peerID)
+	_, err = conn.Write(response.serializeHandshake())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	peer := Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	ch, err := t.setupChannel(conn, peer, request)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// drop connection if torrent is not downloading or seeding
+	select {
+	case t.incoming <- ch:
+	case <-time.After(5 * time.Second):
+		conn.Close()
+	}
+}
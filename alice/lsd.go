@@ -0,0 +1,211 @@
+package alice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery (BEP 14) multicast groups.
+const (
+	lsdAddr4 = "239.192.152.143:6771"
+	lsdAddr6 = "[ff15::efc0:988f]:6771"
+)
+
+// Torrents are announced every 5 minutes, announcements of other peers
+// are waited on for at most a minute to be read by peer discovery.
+const (
+	lsdInterval    = 5 * time.Minute
+	lsdPeerTimeout = time.Minute
+)
+
+// Receives BT-SEARCH announcements on the local network and routes
+// announced peers to torrents by info hash.
+type localDiscovery struct {
+	cookie   string // identifies own announcements
+	conns    []*net.UDPConn
+	mu       sync.RWMutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Shared by all torrents, started on first use and stopped once no
+// torrent is registered anymore.
+var (
+	lsdMu     sync.Mutex
+	activeLSD *localDiscovery
+)
+
+// Join multicast groups (once) and announce torrent periodically.
+//
+// Joining fails only if neither IPv4 nor IPv6 group can be joined.
+func (t *Torrent) requestLSDPeers() error {
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+
+	if activeLSD == nil {
+		ld := &localDiscovery{
+			cookie:   string(generateRandomID(8)),
+			torrents: make(map[[20]byte]*Torrent),
+		}
+		err4 := ld.join("udp4", lsdAddr4)
+		err6 := ld.join("udp6", lsdAddr6)
+		if err4 != nil && err6 != nil {
+			return err4
+		}
+		activeLSD = ld
+	}
+
+	activeLSD.mu.Lock()
+	for _, infoHash := range t.torrentFile.infoHashes() {
+		activeLSD.torrents[infoHash] = t
+	}
+	activeLSD.mu.Unlock()
+
+	// peers could not connect to us without a listen port
+	if t.port != 0 {
+		go activeLSD.announce(t)
+	}
+	return nil
+}
+
+// Stop routing announced peers to the torrent, multicast groups are left
+// once no torrent is registered.
+func (t *Torrent) stopLSD() {
+	lsdMu.Lock()
+	defer lsdMu.Unlock()
+	if activeLSD == nil {
+		return
+	}
+
+	activeLSD.mu.Lock()
+	for infoHash, other := range activeLSD.torrents {
+		if other == t {
+			delete(activeLSD.torrents, infoHash)
+		}
+	}
+	empty := len(activeLSD.torrents) == 0
+	activeLSD.mu.Unlock()
+
+	if empty {
+		for _, conn := range activeLSD.conns {
+			conn.Close()
+		}
+		activeLSD = nil
+	}
+}
+
+func (ld *localDiscovery) join(network, address string) error {
+	group, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP(network, nil, group)
+	if err != nil {
+		return err
+	}
+	ld.conns = append(ld.conns, conn)
+	go ld.receive(conn)
+	return nil
+}
+
+func (ld *localDiscovery) receive(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		size, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		ld.handleAnnouncement(buf[:size], addr.IP)
+	}
+}
+
+// BT-SEARCH announcement is an HTTP-like request with headers:
+//   - Host (multicast group)
+//   - Port (listen port of the announcing peer)
+//   - Infohash (hex info hash, may be repeated for several torrents)
+//   - cookie (optional, used to recognize own announcements)
+func createAnnouncement(host string, port int, infoHashes [][20]byte, cookie string) []byte {
+	var b strings.Builder
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", infoHash)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+	return []byte(b.String())
+}
+
+func (ld *localDiscovery) handleAnnouncement(data []byte, ip net.IP) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil || req.Method != "BT-SEARCH" {
+		return
+	}
+	if req.Header.Get("cookie") == ld.cookie {
+		return
+	}
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return
+	}
+	peer := Peer{IP: ip, Port: uint16(port)}
+
+	for _, value := range req.Header.Values("Infohash") {
+		var infoHash [20]byte
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(decoded) != len(infoHash) {
+			continue
+		}
+		copy(infoHash[:], decoded)
+
+		ld.mu.RLock()
+		t, ok := ld.torrents[infoHash]
+		ld.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		go func() {
+			select {
+			case t.peers <- []Peer{peer}:
+			case <-time.After(lsdPeerTimeout):
+			case <-t.stopping:
+			}
+		}()
+	}
+}
+
+// Multicast announcements of the torrent to both groups until
+// OutputToFile is called.
+func (ld *localDiscovery) announce(t *Torrent) {
+	for {
+		for _, group := range []struct{ network, address string }{
+			{"udp4", lsdAddr4},
+			{"udp6", lsdAddr6},
+		} {
+			raddr, err := net.ResolveUDPAddr(group.network, group.address)
+			if err != nil {
+				continue
+			}
+			conn, err := net.DialUDP(group.network, nil, raddr)
+			if err != nil {
+				continue
+			}
+			conn.Write(createAnnouncement(group.address, t.port, t.metainfo().infoHashes(), ld.cookie))
+			conn.Close()
+		}
+
+		select {
+		case <-time.After(lsdInterval):
+		case <-t.stopping:
+			return
+		}
+	}
+}
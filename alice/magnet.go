@@ -0,0 +1,161 @@
+package alice
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet link of the form
+// magnet:?xt=urn:btih:<info hash>&dn=<name>&tr=<tracker>&x.pe=<host:port>
+//
+// Info hash is either 40 hex or 32 base32 characters long. Parameters
+// tr and x.pe can be repeated.
+//
+// Links of v2 torrents carry xt=urn:btmh:1220<v2 info hash> (multihash
+// of SHA-256 in hex) instead of or in addition to urn:btih.
+type magnetLink struct {
+	InfoHash   [20]byte
+	InfoHashV2 [32]byte // zero if not present
+	Name       string
+	Trackers   []string
+	Peers      []Peer
+}
+
+func parseMagnet(uri string) (*magnetLink, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected magnet scheme but got %q", u.Scheme)
+	}
+
+	params := u.Query()
+	magnet := magnetLink{
+		Name:     params.Get("dn"),
+		Trackers: params["tr"],
+	}
+
+	found, foundV2 := false, false
+	for _, xt := range params["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:") && !found:
+			magnet.InfoHash, err = decodeInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+			if err != nil {
+				return nil, err
+			}
+			found = true
+		case strings.HasPrefix(xt, "urn:btmh:") && !foundV2:
+			magnet.InfoHashV2, err = decodeInfoHashV2(strings.TrimPrefix(xt, "urn:btmh:"))
+			if err != nil {
+				return nil, err
+			}
+			foundV2 = true
+		}
+	}
+	if !found && !foundV2 {
+		return nil, fmt.Errorf("magnet link is missing urn:btih or urn:btmh info hash")
+	}
+	if !found {
+		// v2 swarm is identified by the truncated v2 info hash
+		copy(magnet.InfoHash[:], magnet.InfoHashV2[:])
+	}
+
+	for _, pe := range params["x.pe"] {
+		peer, err := resolvePeer(pe)
+		if err != nil {
+			continue
+		}
+		magnet.Peers = append(magnet.Peers, peer)
+	}
+
+	return &magnet, nil
+}
+
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+
+	switch len(encoded) {
+	case 40:
+		buf, err = hex.DecodeString(encoded)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		err = fmt.Errorf("info hash %q has invalid length %d", encoded, len(encoded))
+	}
+	if err != nil {
+		return infoHash, err
+	}
+
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+// Decode SHA-256 multihash, 1220 followed by 64 hex characters.
+func decodeInfoHashV2(encoded string) ([32]byte, error) {
+	var infoHash [32]byte
+	if len(encoded) != 68 || !strings.HasPrefix(encoded, "1220") {
+		return infoHash, fmt.Errorf("info hash %q is not a SHA-256 multihash", encoded)
+	}
+	buf, err := hex.DecodeString(encoded[4:])
+	if err != nil {
+		return infoHash, err
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+// Convert host:port (host might be a hostname) into a Peer.
+func resolvePeer(hostport string) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return Peer{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return Peer{}, err
+		}
+		ip = addr.IP
+	}
+	return Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+// Create a torrent from the magnet link.
+//
+// Only info hash, name and trackers are known until FetchMetadata
+// retrieves the info dictionary from peers.
+func NewTorrentFromMagnet(uri, outputPath string) (*Torrent, error) {
+	magnet, err := parseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := TorrentFile{
+		InfoHash:   magnet.InfoHash,
+		InfoHashV2: magnet.InfoHashV2,
+		Name:       magnet.Name,
+	}
+	if len(magnet.Trackers) > 0 {
+		// trackers of a magnet link are equivalent and form a single tier
+		tf.Announce = magnet.Trackers[0]
+		tf.AnnounceList = shuffleAnnounceList([][]string{magnet.Trackers})
+	}
+
+	t := NewTorrent("", outputPath)
+	t.torrentFile = &tf
+	t.initialPeers = magnet.Peers
+	return t, nil
+}
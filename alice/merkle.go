@@ -0,0 +1,121 @@
+package alice
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// Leaves of v2 merkle trees (BEP 52) are SHA-256 hashes of 16kB blocks.
+const merkleBlockSize = 16 * 1024
+
+// Hash of two sibling nodes.
+func merkleHash(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// Hash of a subtree of the given height with only zero leaves, used to
+// pad layers beyond the end of a file.
+func padHash(height int) [32]byte {
+	var hash [32]byte
+	for i := 0; i < height; i++ {
+		hash = merkleHash(hash, hash)
+	}
+	return hash
+}
+
+func nextPowerOfTwo(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Base 2 logarithm of a power of two.
+func log2(n int) int {
+	return bits.Len(uint(n)) - 1
+}
+
+// Layer above the given one, which has to have an even number of nodes.
+func merkleParents(layer [][32]byte) [][32]byte {
+	parents := make([][32]byte, len(layer)/2)
+	for i := range parents {
+		parents[i] = merkleHash(layer[2*i], layer[2*i+1])
+	}
+	return parents
+}
+
+// Pad layer with the given hash to numNodes (power of two).
+func padLayer(layer [][32]byte, numNodes int, pad [32]byte) [][32]byte {
+	padded := make([][32]byte, numNodes)
+	copy(padded, layer)
+	for i := len(layer); i < numNodes; i++ {
+		padded[i] = pad
+	}
+	return padded
+}
+
+// Root of the tree with the given layer padded to numNodes.
+func merkleRoot(layer [][32]byte, numNodes int, pad [32]byte) [32]byte {
+	nodes := padLayer(layer, numNodes, pad)
+	for len(nodes) > 1 {
+		nodes = merkleParents(nodes)
+	}
+	return nodes[0]
+}
+
+// Leaf hashes of data, the last block might be shorter.
+func blockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+merkleBlockSize-1)/merkleBlockSize)
+	for begin := 0; begin < len(data); begin += merkleBlockSize {
+		end := begin + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+	return hashes
+}
+
+// Hashes of the requested part of the layer followed by the uncle hashes
+// proving them against the root, bottom up (BEP 52).
+//
+// Layer is padded with pad to numNodes. Length has to be a power of two
+// and index a multiple of it. Proof layers count the layers above the
+// layer, uncles within the requested part are left out.
+func merkleProof(layer [][32]byte, numNodes int, pad [32]byte, index, length, proofLayers int) [][32]byte {
+	nodes := padLayer(layer, numNodes, pad)
+	hashes := append([][32]byte(nil), nodes[index:index+length]...)
+
+	for len(nodes) > numNodes/length {
+		nodes = merkleParents(nodes)
+	}
+	position := index / length
+	for i := log2(length); i < proofLayers && len(nodes) > 1; i++ {
+		hashes = append(hashes, nodes[position^1])
+		nodes = merkleParents(nodes)
+		position /= 2
+	}
+	return hashes
+}
+
+// Check hashes of a layer part at index against the root using uncle
+// hashes ordered bottom up.
+func verifyMerkleProof(hashes [][32]byte, index int, proof [][32]byte, root [32]byte) bool {
+	if len(hashes) == 0 || len(hashes)&(len(hashes)-1) != 0 || index%len(hashes) != 0 {
+		return false
+	}
+	node := merkleRoot(hashes, len(hashes), [32]byte{})
+	position := index / len(hashes)
+	for _, uncle := range proof {
+		if position%2 == 0 {
+			node = merkleHash(node, uncle)
+		} else {
+			node = merkleHash(uncle, node)
+		}
+		position /= 2
+	}
+	return position == 0 && node == root
+}
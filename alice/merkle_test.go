@@ -0,0 +1,78 @@
+package alice
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Three blocks of a file, the last one shorter than a block.
+var testV2Data = strings.Repeat("a", merkleBlockSize) + strings.Repeat("b", merkleBlockSize) + strings.Repeat("c", 100)
+
+const testV2Root = "6745cd3dd5e66eb4754995c1d95784ad85f2b9afdbbf03128036019543dc2393"
+
+func TestPadHash(t *testing.T) {
+	tests := []struct {
+		height int
+		hash   string
+	}{
+		{0, strings.Repeat("00", 32)},
+		{1, "f5a5fd42d16a20302798ef6ed309979b43003d2320d9f0e8ea9831a92759fb4b"},
+		{2, "db56114e00fdd4c1f85c892bf35ac9a89289aaecb1ebd0a96cde606a748b5d71"},
+	}
+	for _, test := range tests {
+		hash := padHash(test.height)
+		if hex.EncodeToString(hash[:]) != test.hash {
+			t.Errorf("padHash(%d) = %x, want %s", test.height, hash, test.hash)
+		}
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := blockHashes([]byte(testV2Data))
+	want := []string{
+		"f3336bea752b5a28743033dd2c844a4a63fba08871aaee2586a2bf2d69be83a2",
+		"e33f24140499430b048f6600af4f41f3ccb0cb766d9f7661124cf8ba4b827523",
+		"bdcdc9e9204fe2099666b438af288629b1fa7f89797341bf7d435ce4ca2b706b",
+	}
+	if len(leaves) != len(want) {
+		t.Fatalf("%d leaves, want %d", len(leaves), len(want))
+	}
+	for i, leaf := range leaves {
+		if hex.EncodeToString(leaf[:]) != want[i] {
+			t.Errorf("leaf %d = %x, want %s", i, leaf, want[i])
+		}
+	}
+
+	root := merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{})
+	if hex.EncodeToString(root[:]) != testV2Root {
+		t.Errorf("root = %x, want %s", root, testV2Root)
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	leaves := blockHashes([]byte(testV2Data))
+	root := merkleRoot(leaves, 4, [32]byte{})
+
+	tests := []struct {
+		index, length int
+	}{
+		{0, 1},
+		{1, 1},
+		{2, 1},
+		{0, 2},
+		{2, 2},
+		{0, 4},
+	}
+	for _, test := range tests {
+		proof := merkleProof(leaves, 4, [32]byte{}, test.index, test.length, 2)
+		hashes, uncles := proof[:test.length], proof[test.length:]
+		if !verifyMerkleProof(hashes, test.index, uncles, root) {
+			t.Errorf("proof of %d hashes at %d does not verify", test.length, test.index)
+		}
+		hashes[0][0] ^= 1
+		if verifyMerkleProof(hashes, test.index, uncles, root) {
+			t.Errorf("tampered proof of %d hashes at %d verifies", test.length, test.index)
+		}
+	}
+}
@@ -20,6 +20,10 @@ type messageID uint8
 //   - request 6 (message payload of the form <index><begin><length> requesting a piece)
 //   - piece 7 (message payload of the form <index><begin><block> containing a piece)
 //   - cancel 8 (identical to request message used to cancel block requests)
+//   - extended 20 (extension protocol message of the form <extended ID><payload>)
+//   - hash request 21 (request for merkle tree hashes of a v2 file)
+//   - hashes 22 (requested hashes followed by their proof)
+//   - hash reject 23 (identical to hash request message that is refused)
 const (
 	choke         messageID = 0
 	unchoke       messageID = 1
@@ -30,6 +34,10 @@ const (
 	request       messageID = 6
 	piece         messageID = 7
 	cancel        messageID = 8
+	extended      messageID = 20
+	hashRequest   messageID = 21
+	hashes        messageID = 22
+	hashReject    messageID = 23
 )
 
 // Every message is of the following form:
@@ -49,6 +57,42 @@ func createRequestMessage(index, begin, length int) *Message {
 	return &Message{ID: request, Payload: payload}
 }
 
+// Creates peer message with ID of 8 (CANCEL).
+//
+// Payload is identical to the REQUEST message being canceled.
+func createCancelMessage(index, begin, length int) *Message {
+	msg := createRequestMessage(index, begin, length)
+	msg.ID = cancel
+	return msg
+}
+
+// Extract payload <index><begin><length> from raw REQUEST or CANCEL message.
+func readRequestMessage(msg *Message) (int, int, int, error) {
+	if msg.ID != request && msg.ID != cancel {
+		return 0, 0, 0, fmt.Errorf("expected ID of %d (REQUEST) or %d (CANCEL), got ID %d", request, cancel, msg.ID)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload of length 12, got length %d", len(msg.Payload))
+	}
+
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// Creates peer message with ID of 7 (PIECE).
+//
+// Format of the message: <length=9+X><id=7><index><begin><block>
+func createPieceMessage(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: piece, Payload: payload}
+}
+
 // Creates peer message with ID of 4 (HAVE).
 //
 // Format of the message: <length=5><id=4><payload>
@@ -72,33 +116,19 @@ func readHaveMessage(msg *Message) (int, error) {
 	return index, nil
 }
 
-// Extract block from raw PIECE message into buf.
-func readPieceMessage(index int, buf []byte, msg *Message) (int, error) {
+// Extract index, begin and block from raw PIECE message.
+func readPieceMessage(msg *Message) (int, int, []byte, error) {
 	if msg.ID != piece {
-		return 0, fmt.Errorf("expected ID of %d (PIECE), got ID %d", piece, msg.ID)
+		return 0, 0, nil, fmt.Errorf("expected ID of %d (PIECE), got ID %d", piece, msg.ID)
 	}
 
 	if len(msg.Payload) < 8 {
-		return 0, fmt.Errorf("payload too short: %d < 8", len(msg.Payload))
-	}
-
-	parsedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-	if parsedIndex != index {
-		return 0, fmt.Errorf("expected index %d, got index %d", index, parsedIndex)
+		return 0, 0, nil, fmt.Errorf("payload too short: %d < 8", len(msg.Payload))
 	}
 
+	index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
 	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	if begin >= len(buf) {
-		return 0, fmt.Errorf("begin offset is larger than payload: %d >= %d", begin, len(buf))
-	}
-
-	block := msg.Payload[8:]
-	if begin+len(block) > len(buf) {
-		return 0, fmt.Errorf("block length [%d] is too long for offset %d with length %d", len(block), begin, len(buf))
-	}
-	copy(buf[begin:], block)
-
-	return len(block), nil
+	return index, begin, msg.Payload[8:], nil
 }
 
 // Put together a message.
@@ -167,6 +197,14 @@ func (msg *Message) name() string {
 		return "Piece"
 	case cancel:
 		return "Cancel"
+	case extended:
+		return "Extended"
+	case hashRequest:
+		return "HashRequest"
+	case hashes:
+		return "Hashes"
+	case hashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("unknown message type with ID: %d", msg.ID)
 	}
@@ -0,0 +1,291 @@
+package alice
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Metadata (info dictionary) is exchanged in pieces of 16kB (BEP 9).
+const metadataPieceSize = 16 * 1024
+
+// Refuse metadata larger than this to avoid allocating arbitrary amounts.
+const maxMetadataSize = 16 * 1024 * 1024
+
+// Extended message ID we expect peers to use for ut_metadata messages.
+const localMetadataID = 1
+
+// ut_metadata message types:
+//   - request 0 (ask for the piece of metadata)
+//   - data 1 (piece of metadata appended after the dictionary)
+//   - reject 2 (peer does not have the requested piece)
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// Extract ut_metadata dictionary and data that follows it (only present
+// for data messages).
+func readMetadataMessage(payload []byte) (*metadataMessage, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(payload))
+	decoded, err := bencode.Decode(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("expected ut_metadata dictionary")
+	}
+
+	msg := metadataMessage{}
+	msgType, ok := dict["msg_type"].(int64)
+	if !ok {
+		return nil, nil, fmt.Errorf("ut_metadata message is missing msg_type")
+	}
+	index, ok := dict["piece"].(int64)
+	if !ok {
+		return nil, nil, fmt.Errorf("ut_metadata message is missing piece")
+	}
+	totalSize, _ := dict["total_size"].(int64)
+	msg.MsgType = int(msgType)
+	msg.Piece = int(index)
+	msg.TotalSize = int(totalSize)
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &msg, data, nil
+}
+
+func (ch *Channel) sendMetadataRequest(index int) error {
+	return ch.sendMetadataMessage(&metadataMessage{MsgType: metadataRequest, Piece: index}, nil)
+}
+
+func (ch *Channel) sendMetadataReject(index int) error {
+	return ch.sendMetadataMessage(&metadataMessage{MsgType: metadataReject, Piece: index}, nil)
+}
+
+func (ch *Channel) sendMetadataData(index, totalSize int, data []byte) error {
+	msg := metadataMessage{MsgType: metadataData, Piece: index, TotalSize: totalSize}
+	return ch.sendMetadataMessage(&msg, data)
+}
+
+// Send ut_metadata dictionary followed by data (data messages only).
+func (ch *Channel) sendMetadataMessage(msg *metadataMessage, data []byte) error {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *msg)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return ch.sendExtended("ut_metadata", buf.Bytes())
+}
+
+// Answer ut_metadata request with the piece of the info dictionary,
+// rejected while metadata of a magnet link is unknown.
+func (ch *Channel) serveMetadataRequest(index int) error {
+	info := ch.torrent.metainfo().RawInfo
+	numPieces := (len(info) + metadataPieceSize - 1) / metadataPieceSize
+	if index < 0 || index >= numPieces {
+		return ch.sendMetadataReject(index)
+	}
+
+	begin := index * metadataPieceSize
+	end := begin + metadataPieceSize
+	if end > len(info) {
+		end = len(info)
+	}
+	return ch.sendMetadataData(index, len(info), info[begin:end])
+}
+
+// Read messages until an extended message arrives that is not consumed by
+// the channel itself. Returns extended ID and payload of that message.
+func (ch *Channel) readExtendedMessage() (uint8, []byte, error) {
+	for {
+		msg, err := ch.read()
+		if err != nil {
+			return 0, nil, err
+		}
+		if msg == nil || msg.ID != extended {
+			continue
+		}
+		id, payload, err := readExtendedMessage(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		if id == extendedHandshakeID {
+			err = ch.handleExtendedMessage(msg)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		return id, payload, nil
+	}
+}
+
+// Download info dictionary from a single peer using ut_metadata.
+//
+// Piece layers of v2 torrents are not part of the info dictionary and
+// are requested from the same peer. They are optional for hybrid
+// torrents which can be checked against v1 hashes.
+func (t *Torrent) requestMetadata(peer Peer) (*TorrentFile, error) {
+	infoHash := t.metainfo().InfoHash
+
+	ch, err := t.newChannel(peer, t.peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Conn.Close()
+
+	if !ch.supportsExtension {
+		return nil, fmt.Errorf("peer %s does not support extension protocol", peer)
+	}
+
+	ch.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// wait for the peer's extended handshake
+	for ch.ExtendedHandshake == nil {
+		_, _, err := ch.readExtendedMessage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	size := ch.ExtendedHandshake.MetadataSize
+	if size <= 0 || size > maxMetadataSize {
+		return nil, fmt.Errorf("peer %s sent invalid metadata size %d", peer, size)
+	}
+
+	numPieces := (size + metadataPieceSize - 1) / metadataPieceSize
+	for i := 0; i < numPieces; i++ {
+		err := ch.sendMetadataRequest(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	metadata := make([]byte, size)
+	received := 0
+	for received < numPieces {
+		id, payload, err := ch.readExtendedMessage()
+		if err != nil {
+			return nil, err
+		}
+		if id != localMetadataID {
+			continue
+		}
+		res, data, err := readMetadataMessage(payload)
+		if err != nil {
+			return nil, err
+		}
+		switch res.MsgType {
+		case metadataReject:
+			return nil, fmt.Errorf("peer %s rejected metadata piece %d", peer, res.Piece)
+		case metadataData:
+			begin := res.Piece * metadataPieceSize
+			if res.Piece < 0 || res.Piece >= numPieces || begin+len(data) > size {
+				return nil, fmt.Errorf("peer %s sent invalid metadata piece %d", peer, res.Piece)
+			}
+			copy(metadata[begin:], data)
+			received++
+		}
+	}
+
+	// metadata is only valid if it hashes to the info hash
+	if !t.validMetadata(metadata) {
+		return nil, fmt.Errorf("metadata from peer %s failed integrity check", peer)
+	}
+
+	info, err := decodeDict(metadata)
+	if err != nil {
+		return nil, err
+	}
+	bto := bencodeTorrent{Info: newBencodeInfo(info)}
+	tf, err := bto.toTorrentFile(info, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if tf.hasV2() {
+		if ch.supportsV2 {
+			tf.PieceLayers, err = ch.requestPieceLayers(tf)
+		} else {
+			err = fmt.Errorf("peer %s does not support v2 hash requests", peer)
+		}
+		if err != nil && !tf.hasV1() {
+			return nil, err
+		}
+	}
+	return tf, nil
+}
+
+// Check metadata against the v2 info hash if it is known and against the
+// v1 info hash otherwise.
+func (t *Torrent) validMetadata(metadata []byte) bool {
+	tf := t.metainfo()
+	if tf.hasV2() {
+		return sha256.Sum256(metadata) == tf.InfoHashV2
+	}
+	return sha1.Sum(metadata) == tf.InfoHash
+}
+
+// Replace the torrent file with one built from verified metadata.
+func (t *Torrent) setMetadata(tf *TorrentFile) (*TorrentFile, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// keep trackers from the magnet link
+	tf.Announce = t.torrentFile.Announce
+	tf.AnnounceList = t.torrentFile.AnnounceList
+
+	// readers running concurrently go through metainfo
+	t.torrentFile = tf
+	return tf, nil
+}
+
+// Fetch info dictionary from peers found by DiscoverPeers.
+//
+// Only required for torrents created with NewTorrentFromMagnet. Peers
+// asked for metadata are kept for Download.
+func (t *Torrent) FetchMetadata() (*TorrentFile, error) {
+	if t.torrentFile.Files != nil {
+		return t.torrentFile, nil
+	}
+
+	// first peer to deliver valid metadata wins
+	results := make(chan *TorrentFile, 1)
+	for {
+		select {
+		case peers := <-t.peers:
+			t.metadataPeers = append(t.metadataPeers, peers...)
+			for _, peer := range peers {
+				go func(peer Peer) {
+					tf, err := t.requestMetadata(peer)
+					if err != nil {
+						return
+					}
+					select {
+					case results <- tf:
+					default:
+					}
+				}(peer)
+			}
+		case tf := <-results:
+			return t.setMetadata(tf)
+		}
+	}
+}
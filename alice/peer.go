@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"strconv"
-	"strings"
 )
 
 type Peer struct {
@@ -18,9 +17,20 @@ type Peer struct {
 // Each peer is 6 bytes long: 4 for IP and 2 for port number.
 // Hence, peers list has to be a multiple of 6.
 func Unmarshal(peersBinary []byte) ([]Peer, error) {
-	// check if peers list is multiple of 6
+	return unmarshalPeers(peersBinary, net.IPv4len)
+}
+
+// Unmarshal IPv6 peers list (BEP 7).
+//
+// Each peer is 18 bytes long: 16 for IP and 2 for port number.
+func Unmarshal6(peersBinary []byte) ([]Peer, error) {
+	return unmarshalPeers(peersBinary, net.IPv6len)
+}
+
+func unmarshalPeers(peersBinary []byte, ipLen int) ([]Peer, error) {
+	// check if peers list is multiple of peer size
 	// otherwise, return an error
-	const peerSize = 6
+	peerSize := ipLen + 2
 	if len(peersBinary)%peerSize != 0 {
 		err := fmt.Errorf("received malformed binary of peers")
 		return nil, err
@@ -31,23 +41,55 @@ func Unmarshal(peersBinary []byte) ([]Peer, error) {
 	peers := make([]Peer, numPeers)
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-		peers[i].IP = net.IP(peersBinary[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16(peersBinary[offset+4 : offset+6])
+		peers[i].IP = net.IP(peersBinary[offset : offset+ipLen])
+		peers[i].Port = binary.BigEndian.Uint16(peersBinary[offset+ipLen : offset+peerSize])
 	}
 
 	return peers, nil
 }
 
+// Marshal peer in compact format, 6 bytes for IPv4 and 18 bytes for
+// IPv6 peers.
+func marshalPeer(p Peer) []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.Port)
+	return buf
+}
+
 // Return Peer ip and port with suitable format - ip:port
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
+// Parse ip:port, IPv6 addresses are enclosed in brackets.
 func toPeer(peer string) Peer {
-	addr := strings.Split(peer, ":")
-	port, _ := strconv.Atoi(addr[1])
+	host, portStr, _ := net.SplitHostPort(peer)
+	port, _ := strconv.Atoi(portStr)
 	return Peer{
-		IP:   net.ParseIP(addr[0]),
+		IP:   net.ParseIP(host),
 		Port: uint16(port),
 	}
 }
+
+// Find global IPv6 address of this host, nil if there is none.
+func localIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil {
+			continue
+		}
+		if ipNet.IP.IsGlobalUnicast() && !ipNet.IP.IsPrivate() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
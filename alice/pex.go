@@ -0,0 +1,207 @@
+package alice
+
+import (
+	"bytes"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Extended message ID we expect peers to use for ut_pex messages.
+const localPexID = 2
+
+// Peers are exchanged at most once per minute (BEP 11), a single message
+// adds or drops at most 50 peers.
+const (
+	pexInterval = time.Minute
+	maxPexPeers = 50
+)
+
+// Flag of added peers that accepted a connection from the sender.
+const pexOutgoing = 0x10
+
+// ut_pex message lists peers connected (added) and disconnected (dropped)
+// since the previous message in compact format. Flags hold one byte per
+// added peer.
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// Connected peer as shared with other peers.
+type pexPeer struct {
+	peer  Peer
+	flags byte
+}
+
+// Peers connected to the client that others can connect to as well.
+//
+// Incoming connections come from ephemeral ports, such peers are only
+// shared if their listen port is known from the extended handshake.
+func (t *Torrent) pexPeers() map[string]pexPeer {
+	t.mu.RLock()
+	channels := make([]*Channel, 0, len(t.channels))
+	for ch := range t.channels {
+		channels = append(channels, ch)
+	}
+	t.mu.RUnlock()
+
+	peers := make(map[string]pexPeer, len(channels))
+	for _, ch := range channels {
+		if ch.outgoing {
+			peers[ch.peer.String()] = pexPeer{ch.peer, pexOutgoing}
+			continue
+		}
+		port := ch.listenPort()
+		if port <= 0 || port > 65535 {
+			continue
+		}
+		peer := Peer{IP: ch.peer.IP, Port: uint16(port)}
+		peers[peer.String()] = pexPeer{peer, 0}
+	}
+	return peers
+}
+
+// Periodically tell connected peers about peers that were connected or
+// disconnected since the previous message, until OutputToFile is called.
+func (t *Torrent) runPex() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.stopping:
+			return
+		}
+		peers := t.pexPeers()
+
+		t.mu.RLock()
+		channels := make([]*Channel, 0, len(t.channels))
+		for ch := range t.channels {
+			channels = append(channels, ch)
+		}
+		t.mu.RUnlock()
+
+		for _, ch := range channels {
+			if _, ok := ch.remoteExtensionID("ut_pex"); ok {
+				ch.sendPex(peers)
+			}
+		}
+	}
+}
+
+// Send difference between the given peers and the peers sent before.
+//
+// Peers exceeding the limit are left for the next message.
+func (ch *Channel) sendPex(peers map[string]pexPeer) error {
+	var added []pexPeer
+	var dropped []Peer
+	for key, p := range peers {
+		if _, ok := ch.pexSent[key]; ok || key == ch.peer.String() {
+			continue
+		}
+		if len(added) < maxPexPeers {
+			added = append(added, p)
+		}
+	}
+	for key, p := range ch.pexSent {
+		if _, ok := peers[key]; ok {
+			continue
+		}
+		if len(dropped) < maxPexPeers {
+			dropped = append(dropped, p.peer)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	msg := pexMessage{}
+	var added4, added6 []byte
+	var flags4, flags6 []byte
+	for _, p := range added {
+		if ip := p.peer.IP.To4(); ip != nil {
+			added4 = append(added4, marshalPeer(p.peer)...)
+			flags4 = append(flags4, p.flags)
+		} else {
+			added6 = append(added6, marshalPeer(p.peer)...)
+			flags6 = append(flags6, p.flags)
+		}
+	}
+	var dropped4, dropped6 []byte
+	for _, p := range dropped {
+		if ip := p.IP.To4(); ip != nil {
+			dropped4 = append(dropped4, marshalPeer(p)...)
+		} else {
+			dropped6 = append(dropped6, marshalPeer(p)...)
+		}
+	}
+	msg.Added, msg.AddedF = string(added4), string(flags4)
+	msg.Added6, msg.Added6F = string(added6), string(flags6)
+	msg.Dropped, msg.Dropped6 = string(dropped4), string(dropped6)
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return err
+	}
+	err = ch.sendExtended("ut_pex", buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if ch.pexSent == nil {
+		ch.pexSent = make(map[string]pexPeer)
+	}
+	for _, p := range added {
+		ch.pexSent[p.peer.String()] = p
+	}
+	for _, p := range dropped {
+		delete(ch.pexSent, p.String())
+	}
+	return nil
+}
+
+// Feed peers added by the peer to peer discovery, ignored for private
+// torrents.
+func (ch *Channel) handlePex(payload []byte) error {
+	if ch.torrent.metainfo().Private {
+		return nil
+	}
+
+	msg := pexMessage{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &msg)
+	if err != nil {
+		return err
+	}
+
+	added, err := Unmarshal([]byte(msg.Added))
+	if err != nil {
+		return err
+	}
+	added6, err := Unmarshal6([]byte(msg.Added6))
+	if err != nil {
+		return err
+	}
+	added = append(added, added6...)
+	if len(added) > maxPexPeers {
+		added = added[:maxPexPeers]
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	// peer discovery might not be read from right now
+	go func() {
+		select {
+		case ch.torrent.peers <- added:
+		case <-ch.done:
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,438 @@
+package alice
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Pieces are picked at random until this many pieces are completed so
+// that there is something to share with other peers as soon as possible.
+const randomFirstPieces = 4
+
+// Decides which block each peer should request next.
+//
+// Blocks of pieces already being downloaded are requested first so that
+// a piece can be downloaded from several peers in parallel. New pieces
+// are started rarest first, availability of pieces is tracked from
+// bitfields and HAVE messages of all connected peers.
+//
+// Once every missing block is requested (endgame), idle peers request
+// blocks other peers have outstanding as well. The first copy of a block
+// to arrive is kept and the duplicate requests are canceled.
+//
+// Web seeds download whole pieces, they request all missing blocks of a
+// piece at once.
+type piecePicker struct {
+	mu           sync.Mutex
+	torrentFile  *TorrentFile
+	availability []int  // number of peers having each piece
+	pending      []bool // pieces not completed and not being downloaded
+	numPending   int
+	remaining    int // pieces not completed yet
+	completed    int // pieces completed (including existing data)
+	active       map[int]*pieceState
+	outstanding  map[blockSource]int // number of requests per peer
+	wake         chan struct{}
+	done         chan struct{}
+}
+
+// Source of blocks scheduled by the picker, a connected peer or a web
+// seed.
+type blockSource interface {
+	hasPiece(index int) bool
+	cancelBlock(index, begin, length int)
+}
+
+// Piece being downloaded, shared by all peers downloading its blocks.
+//
+// Received blocks are kept when peers disconnect, only a failed integrity
+// check discards them.
+type pieceState struct {
+	index       int
+	length      int
+	buffer      []byte
+	received    []bool                     // per block
+	requests    []map[blockSource]struct{} // peers that requested each block
+	numReceived int
+	finished    bool // all blocks received
+}
+
+// Block of a piece requested from peer.
+type blockRef struct {
+	index  int
+	begin  int
+	length int
+}
+
+func newPiecePicker(tf *TorrentFile, have Bitfield) *piecePicker {
+	pp := piecePicker{
+		torrentFile:  tf,
+		availability: make([]int, tf.numPieces()),
+		pending:      make([]bool, tf.numPieces()),
+		active:       make(map[int]*pieceState),
+		outstanding:  make(map[blockSource]int),
+		wake:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for index := 0; index < tf.numPieces(); index++ {
+		if have.hasPiece(index) {
+			pp.completed++
+			continue
+		}
+		pp.pending[index] = true
+		pp.numPending++
+		pp.remaining++
+	}
+	if pp.remaining == 0 {
+		close(pp.done)
+	}
+	return &pp
+}
+
+func (pp *piecePicker) newPieceState(index int) *pieceState {
+	begin, end := calcPieceBounds(pp.torrentFile, index)
+	length := end - begin
+	numBlocks := (length + maxBlockSize - 1) / maxBlockSize
+	return &pieceState{
+		index:    index,
+		length:   length,
+		buffer:   make([]byte, length),
+		received: make([]bool, numBlocks),
+		requests: make([]map[blockSource]struct{}, numBlocks),
+	}
+}
+
+// Return offset and length of the block.
+func (ps *pieceState) blockBounds(block int) (int, int) {
+	begin := block * maxBlockSize
+	length := maxBlockSize
+	if ps.length-begin < length {
+		length = ps.length - begin
+	}
+	return begin, length
+}
+
+// Count pieces of newly connected peer.
+func (pp *piecePicker) addPeer(bf Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for index := range pp.availability {
+		if bf.hasPiece(index) {
+			pp.availability[index]++
+		}
+	}
+}
+
+// Forget pieces and requests of disconnected peer.
+func (pp *piecePicker) removePeer(ch *Channel) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for index := range pp.availability {
+		if ch.Bitfield.hasPiece(index) {
+			pp.availability[index]--
+		}
+	}
+	pp.dropRequestsLocked(ch)
+}
+
+// Count piece peer announced with HAVE message.
+func (pp *piecePicker) peerHas(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if index >= 0 && index < len(pp.availability) {
+		pp.availability[index]++
+	}
+}
+
+// Pick next block for the peer to request, false if peer has no block
+// that is still needed.
+func (pp *piecePicker) request(src blockSource) (blockRef, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	ps, block := pp.pickActive(src)
+	if ps == nil {
+		index := pp.pickPending(src)
+		if index != -1 {
+			ps = pp.newPieceState(index)
+			pp.active[index] = ps
+			pp.pending[index] = false
+			pp.numPending--
+			block = 0
+			if pp.numPending == 0 {
+				// idle peers can request duplicate blocks in endgame
+				pp.notify()
+			}
+		}
+	}
+	if ps == nil {
+		ps, block = pp.pickEndgame(src)
+	}
+	if ps == nil {
+		return blockRef{}, false
+	}
+
+	if ps.requests[block] == nil {
+		ps.requests[block] = make(map[blockSource]struct{})
+	}
+	ps.requests[block][src] = struct{}{}
+	pp.outstanding[src]++
+
+	begin, length := ps.blockBounds(block)
+	return blockRef{ps.index, begin, length}, true
+}
+
+// Pick piece for the source to download as a whole and request all of its
+// missing blocks. Returns -1 if there is none.
+//
+// Pieces being downloaded are only picked if none of their missing blocks
+// is requested, e.g. after the peers downloading them disconnected.
+func (pp *piecePicker) requestPiece(src blockSource) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	var ps *pieceState
+	index := pp.pickPending(src)
+	if index != -1 {
+		ps = pp.newPieceState(index)
+		pp.active[index] = ps
+		pp.pending[index] = false
+		pp.numPending--
+		if pp.numPending == 0 {
+			pp.notify()
+		}
+	} else {
+		ps = pp.pickIdle(src)
+	}
+	if ps == nil {
+		return -1
+	}
+
+	for block, received := range ps.received {
+		if received {
+			continue
+		}
+		if ps.requests[block] == nil {
+			ps.requests[block] = make(map[blockSource]struct{})
+		}
+		ps.requests[block][src] = struct{}{}
+		pp.outstanding[src]++
+	}
+	return ps.index
+}
+
+// Find piece being downloaded without any outstanding requests.
+func (pp *piecePicker) pickIdle(src blockSource) *pieceState {
+	for index, ps := range pp.active {
+		if ps.finished || !src.hasPiece(index) {
+			continue
+		}
+		idle := true
+		for block, received := range ps.received {
+			if !received && len(ps.requests[block]) > 0 {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return ps
+		}
+	}
+	return nil
+}
+
+// Find block nobody requested in pieces being downloaded, pieces closest
+// to completion are preferred.
+func (pp *piecePicker) pickActive(src blockSource) (*pieceState, int) {
+	var best *pieceState
+	bestBlock := -1
+	for index, ps := range pp.active {
+		if ps.finished || !src.hasPiece(index) {
+			continue
+		}
+		if best != nil && ps.numReceived <= best.numReceived {
+			continue
+		}
+		for block, received := range ps.received {
+			if !received && len(ps.requests[block]) == 0 {
+				best, bestBlock = ps, block
+				break
+			}
+		}
+	}
+	return best, bestBlock
+}
+
+// Find piece to start downloading, rarest first (random for the first
+// few pieces). Returns -1 if there is none.
+func (pp *piecePicker) pickPending(src blockSource) int {
+	numPieces := len(pp.pending)
+	if pp.numPending == 0 {
+		return -1
+	}
+
+	best := -1
+	candidates := 0
+	offset := rand.Intn(numPieces) // break ties randomly
+	for i := 0; i < numPieces; i++ {
+		index := (i + offset) % numPieces
+		if !pp.pending[index] || !src.hasPiece(index) {
+			continue
+		}
+		if pp.completed < randomFirstPieces {
+			// reservoir sampling over all candidates
+			candidates++
+			if rand.Intn(candidates) == 0 {
+				best = index
+			}
+			continue
+		}
+		if best == -1 || pp.availability[index] < pp.availability[best] {
+			best = index
+		}
+	}
+	return best
+}
+
+// Find block requested by other peers but not by this one, blocks with the
+// fewest requests are preferred. Only used once all blocks are requested.
+func (pp *piecePicker) pickEndgame(src blockSource) (*pieceState, int) {
+	if pp.numPending != 0 {
+		return nil, -1
+	}
+
+	var best *pieceState
+	bestBlock := -1
+	for index, ps := range pp.active {
+		if ps.finished || !src.hasPiece(index) {
+			continue
+		}
+		for block, received := range ps.received {
+			if received {
+				continue
+			}
+			if _, ok := ps.requests[block][src]; ok {
+				continue
+			}
+			if best == nil || len(ps.requests[block]) < len(best.requests[bestBlock]) {
+				best, bestBlock = ps, block
+			}
+		}
+	}
+	return best, bestBlock
+}
+
+// Number of blocks requested by peer but not received yet.
+func (pp *piecePicker) requests(src blockSource) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.outstanding[src]
+}
+
+// Forget requests of the peer so that the blocks can be requested from
+// other peers, e.g. after the peer choked us.
+func (pp *piecePicker) dropRequests(src blockSource) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.dropRequestsLocked(src)
+}
+
+func (pp *piecePicker) dropRequestsLocked(src blockSource) {
+	if pp.outstanding[src] == 0 {
+		delete(pp.outstanding, src)
+		return
+	}
+	for _, ps := range pp.active {
+		for _, requests := range ps.requests {
+			delete(requests, src)
+		}
+	}
+	delete(pp.outstanding, src)
+	pp.notify()
+}
+
+// Store block received from peer in its piece.
+//
+// Duplicate requests of the block are canceled. Returns the piece if the
+// block completed it, the peer that completed it has to finish it.
+func (pp *piecePicker) receiveBlock(src blockSource, index, begin int, block []byte) *pieceState {
+	pp.mu.Lock()
+	ps, ok := pp.active[index]
+	if !ok || begin%maxBlockSize != 0 || begin/maxBlockSize >= len(ps.received) {
+		pp.mu.Unlock()
+		return nil
+	}
+	b := begin / maxBlockSize
+	if _, length := ps.blockBounds(b); ps.received[b] || len(block) != length {
+		pp.mu.Unlock()
+		return nil
+	}
+
+	copy(ps.buffer[begin:], block)
+	ps.received[b] = true
+	ps.numReceived++
+
+	var duplicates []blockSource
+	for requester := range ps.requests[b] {
+		pp.outstanding[requester]--
+		if requester != src {
+			duplicates = append(duplicates, requester)
+		}
+	}
+	ps.requests[b] = nil
+
+	var complete *pieceState
+	if ps.numReceived == len(ps.received) {
+		ps.finished = true
+		complete = ps
+	}
+	pp.mu.Unlock()
+
+	for _, other := range duplicates {
+		other.cancelBlock(index, begin, len(block))
+	}
+	return complete
+}
+
+// Record result of the integrity check of a complete piece. Failed piece
+// is downloaded again from scratch.
+func (pp *piecePicker) finish(ps *pieceState, ok bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	delete(pp.active, ps.index)
+	if !ok {
+		pp.pending[ps.index] = true
+		pp.numPending++
+		pp.notify()
+	}
+}
+
+// Wake up peers waiting for work.
+func (pp *piecePicker) notify() {
+	close(pp.wake)
+	pp.wake = make(chan struct{})
+}
+
+// Record verified and stored piece.
+func (pp *piecePicker) complete(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.completed++
+	pp.remaining--
+	if pp.remaining == 0 {
+		close(pp.done)
+	}
+}
+
+// Channel closed when there might be new work for waiting peers.
+func (pp *piecePicker) wakeup() <-chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.wake
+}
+
+// Channel closed when all pieces are completed.
+func (pp *piecePicker) finished() <-chan struct{} {
+	return pp.done
+}
@@ -0,0 +1,130 @@
+package alice
+
+import (
+	"math"
+	"time"
+)
+
+// Bounds of the number of outstanding requests per peer.
+const (
+	minPipelineDepth     = 2
+	initialPipelineDepth = 8
+	maxPipelineDepth     = 500
+)
+
+// Minimum round-trip time is tracked over windows of this length so that
+// changes in network conditions are picked up.
+const rttWindow = 10 * time.Second
+
+// Measures download throughput and round-trip time of a single peer to
+// derive how many requests should be outstanding (bandwidth-delay
+// product).
+type pipeline struct {
+	requestTimes map[[2]int]time.Time // send time of outstanding requests
+	rate         *rateMeter
+	minRTT       time.Duration // minimum in the current window
+	prevMinRTT   time.Duration // minimum in the previous window
+	rttStart     time.Time
+}
+
+func newPipeline() pipeline {
+	now := time.Now()
+	return pipeline{
+		requestTimes: make(map[[2]int]time.Time),
+		rate:         newRateMeter(),
+		rttStart:     now,
+	}
+}
+
+// Record sent request.
+//
+// Requests canceled in endgame are never answered, their send times are
+// pruned once they are too old to be useful.
+func (p *pipeline) requestSent(index, begin int) {
+	now := time.Now()
+	if len(p.requestTimes) > 2*maxPipelineDepth {
+		for key, sent := range p.requestTimes {
+			if now.Sub(sent) > time.Minute {
+				delete(p.requestTimes, key)
+			}
+		}
+	}
+	p.requestTimes[[2]int{index, begin}] = now
+}
+
+// Record received block and update throughput and round-trip time.
+func (p *pipeline) blockReceived(index, begin, length int) {
+	now := time.Now()
+
+	key := [2]int{index, begin}
+	if sent, ok := p.requestTimes[key]; ok {
+		delete(p.requestTimes, key)
+		p.addRTT(now, now.Sub(sent))
+	}
+
+	p.rate.add(length)
+}
+
+func (p *pipeline) addRTT(now time.Time, rtt time.Duration) {
+	if now.Sub(p.rttStart) >= rttWindow {
+		p.prevMinRTT = p.minRTT
+		p.minRTT = 0
+		p.rttStart = now
+	}
+	if p.minRTT == 0 || rtt < p.minRTT {
+		p.minRTT = rtt
+	}
+}
+
+// Forget all outstanding requests (peer choked us).
+func (p *pipeline) forgetAll() {
+	p.requestTimes = make(map[[2]int]time.Time)
+}
+
+// Number of requests to keep outstanding.
+//
+// Bandwidth-delay product is doubled so that the pipeline grows until the
+// peer's bandwidth is saturated. Round-trip time of requests includes time
+// spent waiting in the peer's queue, hence the minimum is used. Depth is
+// capped by the number of requests peer allows (reqq).
+func (p *pipeline) depth(reqq int) int {
+	limit := maxPipelineDepth
+	if reqq > 0 && reqq < limit {
+		limit = reqq
+	}
+
+	rtt := p.minRTT
+	if p.prevMinRTT != 0 && (rtt == 0 || p.prevMinRTT < rtt) {
+		rtt = p.prevMinRTT
+	}
+
+	depth := initialPipelineDepth
+	if rate := p.rate.value(); rate > 0 && rtt > 0 {
+		bdp := rate * rtt.Seconds() / maxBlockSize
+		depth = int(math.Ceil(2*bdp)) + 1
+	}
+
+	if depth < minPipelineDepth {
+		depth = minPipelineDepth
+	}
+	if depth > limit {
+		depth = limit
+	}
+	return depth
+}
+
+// Number of requests to keep outstanding to the peer.
+func (ch *Channel) pipelineDepth() int {
+	ch.mu.Lock()
+	reqq := 0
+	if ch.ExtendedHandshake != nil {
+		reqq = ch.ExtendedHandshake.Reqq
+	}
+	ch.mu.Unlock()
+	return ch.pipeline.depth(reqq)
+}
+
+// Download rate from the peer in bytes per second.
+func (ch *Channel) downloadRate() float64 {
+	return ch.pipeline.rate.value()
+}
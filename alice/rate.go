@@ -0,0 +1,52 @@
+package alice
+
+import (
+	"sync"
+	"time"
+)
+
+// Throughput is averaged over windows of this length.
+const rateWindow = time.Second
+
+// Moving average of transferred bytes per second, safe for concurrent use.
+type rateMeter struct {
+	mu          sync.Mutex
+	rate        float64
+	windowStart time.Time
+	windowBytes int
+}
+
+func newRateMeter() *rateMeter {
+	return &rateMeter{windowStart: time.Now()}
+}
+
+// Record transferred bytes.
+func (rm *rateMeter) add(n int) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.update(time.Now())
+	rm.windowBytes += n
+}
+
+// Return bytes per second, decays when nothing is transferred.
+func (rm *rateMeter) value() float64 {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.update(time.Now())
+	return rm.rate
+}
+
+func (rm *rateMeter) update(now time.Time) {
+	elapsed := now.Sub(rm.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	sample := float64(rm.windowBytes) / elapsed.Seconds()
+	if rm.rate == 0 {
+		rm.rate = sample
+	} else {
+		rm.rate = 0.7*rm.rate + 0.3*sample
+	}
+	rm.windowStart = now
+	rm.windowBytes = 0
+}
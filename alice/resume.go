@@ -0,0 +1,195 @@
+package alice
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Resume file stores completed pieces together with size and modification
+// time of every file at the time of saving. Pieces of files that have not
+// changed since then are trusted without rehashing.
+//
+// Files change with every written piece, the resume file is therefore
+// saved right after the last write when the download is stopped.
+type resumeData struct {
+	InfoHash string       `bencode:"info hash"`
+	Bitfield string       `bencode:"bitfield"`
+	Files    []resumeFile `bencode:"files"`
+}
+
+type resumeFile struct {
+	Length int   `bencode:"length"`
+	MTime  int64 `bencode:"mtime"`
+}
+
+// Location of the resume file next to the downloaded data.
+func (t *Torrent) resumePath() string {
+	tf := t.torrentFile
+	if !tf.isMultiFile() {
+		return t.outputPath + ".resume"
+	}
+	return filepath.Join(t.outputPath, tf.Name+".resume")
+}
+
+// Resume file is only meaningful when data is stored in output file(s).
+func (t *Torrent) usesResumeFile() bool {
+	_, ok := t.storage.(*fileStorage)
+	return t.config.UseResumeFile && ok
+}
+
+// Return size and modification time of every file, nil if any is missing.
+// Padding files are not stored and are left zero.
+func (t *Torrent) statFiles() []resumeFile {
+	files := make([]resumeFile, len(t.torrentFile.Files))
+	for i, f := range t.torrentFile.Files {
+		if f.Padding {
+			continue
+		}
+		info, err := os.Stat(t.torrentFile.filePath(t.outputPath, f))
+		if err != nil {
+			return nil
+		}
+		files[i] = resumeFile{Length: int(info.Size()), MTime: info.ModTime().UnixNano()}
+	}
+	return files
+}
+
+func (t *Torrent) saveResume() error {
+	if !t.usesResumeFile() {
+		return nil
+	}
+
+	// pieces must not be trusted if their data is lost in a crash
+	err := t.storage.(*fileStorage).sync()
+	if err != nil {
+		return err
+	}
+	files := t.statFiles()
+	if files == nil {
+		return nil
+	}
+	rd := resumeData{
+		InfoHash: string(t.torrentFile.InfoHash[:]),
+		Bitfield: string(t.bitfieldCopy()),
+		Files:    files,
+	}
+
+	var buf bytes.Buffer
+	err = bencode.Marshal(&buf, rd)
+	if err != nil {
+		return err
+	}
+
+	// write to temporary file first so that a crash never leaves a
+	// partially written resume file behind
+	path := t.resumePath()
+	err = os.WriteFile(path+".tmp", buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Return pieces that can be trusted without rehashing.
+//
+// Piece is only trusted if none of the files it spans changed since the
+// resume file was saved.
+func (t *Torrent) loadResume() Bitfield {
+	tf := t.torrentFile
+	trusted := make(Bitfield, (tf.numPieces()+7)/8)
+	if !t.usesResumeFile() {
+		return trusted
+	}
+
+	file, err := os.Open(t.resumePath())
+	if err != nil {
+		return trusted
+	}
+	defer file.Close()
+
+	rd := resumeData{}
+	err = bencode.Unmarshal(file, &rd)
+	if err != nil {
+		return trusted
+	}
+	if rd.InfoHash != string(tf.InfoHash[:]) || len(rd.Bitfield) != len(trusted) || len(rd.Files) != len(tf.Files) {
+		return trusted
+	}
+
+	files := t.statFiles()
+	if files == nil {
+		return trusted
+	}
+	saved := Bitfield(rd.Bitfield)
+
+	for index := 0; index < tf.numPieces(); index++ {
+		if !saved.hasPiece(index) {
+			continue
+		}
+		begin, end := calcPieceBounds(tf, index)
+		unchanged := true
+		for _, s := range tf.fileSegments(begin, end) {
+			if files[s.file] != rd.Files[s.file] {
+				unchanged = false
+				break
+			}
+		}
+		if unchanged {
+			trusted.setPiece(index)
+		}
+	}
+	return trusted
+}
+
+// Check existing data against piece hashes and mark valid pieces complete.
+func (t *Torrent) verifyPieces() error {
+	tf := t.torrentFile
+	trusted := t.loadResume()
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var firstErr error
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				if !trusted.hasPiece(index) && !t.verifyPiece(index) {
+					continue
+				}
+				// peers and trackers might already read the bitfield
+				t.mu.Lock()
+				err := t.storage.MarkComplete(index)
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				t.bitfield.setPiece(index)
+				t.piecesDone++
+				t.mu.Unlock()
+			}
+		}()
+	}
+
+	for index := 0; index < tf.numPieces(); index++ {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return firstErr
+}
+
+// Read piece from storage and check it against its hash.
+func (t *Torrent) verifyPiece(index int) bool {
+	buf := make([]byte, t.calcPieceSize(index))
+	_, err := t.storage.ReadAt(buf, index, 0)
+	if err != nil {
+		return false
+	}
+	return t.torrentFile.checkPiece(index, buf) == nil
+}
@@ -0,0 +1,222 @@
+package alice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// UDP trackers accept at most 74 info hashes per scrape request.
+const maxUDPScrapeHashes = 74
+
+// Swarm statistics of a single torrent reported by a tracker.
+type ScrapeResult struct {
+	Complete   int // seeders
+	Incomplete int // leechers
+	Downloaded int // completed downloads
+}
+
+type Scrape struct {
+	Action        uint32 // request & response
+	TransactionID []byte // request & response
+
+	ConnectionID []byte     // request
+	InfoHashes   [][20]byte // request
+
+	Results []ScrapeResult // response
+}
+
+func newScrape(connectionID []byte, infoHashes [][20]byte) *Scrape {
+	return &Scrape{
+		ConnectionID:  connectionID,
+		Action:        actionScrape,
+		TransactionID: generateRandomID(4),
+		InfoHashes:    infoHashes,
+	}
+}
+
+func (s *Scrape) serializeScrape() []byte {
+	buf := make([]byte, 16+20*len(s.InfoHashes))
+	copy(buf[:8], s.ConnectionID[:])
+	binary.BigEndian.PutUint32(buf[8:12], s.Action)
+	copy(buf[12:16], s.TransactionID[:])
+	for i, infoHash := range s.InfoHashes {
+		copy(buf[16+20*i:], infoHash[:])
+	}
+	return buf
+}
+
+func readScrape(buf []byte) (*Scrape, error) {
+	if len(buf) < 8 {
+		err := fmt.Errorf("received invalid scrape response of length %d", len(buf))
+		return nil, err
+	}
+
+	sr := Scrape{
+		Action:        binary.BigEndian.Uint32(buf[0:4]),
+		TransactionID: append([]byte(nil), buf[4:8]...),
+	}
+	for offset := 8; offset+12 <= len(buf); offset += 12 {
+		sr.Results = append(sr.Results, ScrapeResult{
+			Complete:   int(binary.BigEndian.Uint32(buf[offset : offset+4])),
+			Downloaded: int(binary.BigEndian.Uint32(buf[offset+4 : offset+8])),
+			Incomplete: int(binary.BigEndian.Uint32(buf[offset+8 : offset+12])),
+		})
+	}
+	return &sr, nil
+}
+
+// Derive scrape URL from announce URL by replacing "announce" in the last
+// path component with "scrape".
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	i := strings.LastIndex(announce.Path, "/")
+	if i < 0 || !strings.HasPrefix(announce.Path[i+1:], "announce") {
+		err := fmt.Errorf("tracker %s does not support scrape", announce)
+		return nil, err
+	}
+	u := *announce
+	u.Path = announce.Path[:i+1] + "scrape" + announce.Path[i+1+len("announce"):]
+	return &u, nil
+}
+
+func httpScrape(announce *url.URL, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	conn := &http.Client{Timeout: 5 * time.Second}
+	response, err := conn.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// response holds statistics of every requested torrent in the files
+	// dictionary keyed by info hash, decoded generically since keys are
+	// binary
+	data, err := bencode.Decode(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	scrapeResponse, ok := data.(map[string]interface{})
+	if !ok {
+		err := fmt.Errorf("tracker %s sent invalid scrape response", announce.Host)
+		return nil, err
+	}
+	if reason, ok := scrapeResponse["failure reason"].(string); ok {
+		return nil, &TrackerError{Tracker: announce.Host, Reason: reason}
+	}
+	files, _ := scrapeResponse["files"].(map[string]interface{})
+
+	results := make(map[[20]byte]ScrapeResult)
+	for key, value := range files {
+		var infoHash [20]byte
+		dict, ok := value.(map[string]interface{})
+		if !ok || len(key) != len(infoHash) {
+			continue
+		}
+		copy(infoHash[:], key)
+		results[infoHash] = ScrapeResult{
+			Complete:   dictInt(dict, "complete"),
+			Incomplete: dictInt(dict, "incomplete"),
+			Downloaded: dictInt(dict, "downloaded"),
+		}
+	}
+	return results, nil
+}
+
+func udpScrape(host string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	ut, err := dialUDPTracker(host)
+	if err != nil {
+		return nil, err
+	}
+	defer ut.close()
+
+	results := make(map[[20]byte]ScrapeResult)
+	for len(infoHashes) > 0 {
+		n := len(infoHashes)
+		if n > maxUDPScrapeHashes {
+			n = maxUDPScrapeHashes
+		}
+		batch := infoHashes[:n]
+		infoHashes = infoHashes[n:]
+
+		buf, err := ut.request(maxUDPRetransmits, func(connectionID []byte) ([]byte, []byte) {
+			scrapeReq := newScrape(connectionID, batch)
+			return scrapeReq.serializeScrape(), scrapeReq.TransactionID
+		})
+		if err != nil {
+			return nil, err
+		}
+		scrapeRes, err := readScrape(buf)
+		if err != nil {
+			return nil, err
+		}
+		if scrapeRes.Action != actionScrape {
+			err := fmt.Errorf("expected action %d (scrape) received %d", actionScrape, scrapeRes.Action)
+			return nil, err
+		}
+		if len(scrapeRes.Results) != len(batch) {
+			err := fmt.Errorf("expected %d scrape results received %d", len(batch), len(scrapeRes.Results))
+			return nil, err
+		}
+		for i, infoHash := range batch {
+			results[infoHash] = scrapeRes.Results[i]
+		}
+	}
+	return results, nil
+}
+
+// Request swarm statistics of one or many torrents from the tracker at the
+// given announce URL. Torrents unknown to the tracker are missing from the
+// result.
+func ScrapeTracker(announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	base, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch base.Scheme {
+	case "http", "https":
+		return httpScrape(base, infoHashes)
+	case "udp":
+		return udpScrape(base.Host, infoHashes)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", base.Scheme)
+}
+
+// Request swarm statistics of the torrent from its trackers, the first
+// tracker to respond is used.
+func (t *Torrent) Scrape() (ScrapeResult, error) {
+	tf := t.metainfo()
+	var announceList []string
+	for _, tier := range t.announceTiers() {
+		announceList = append(announceList, tier...)
+	}
+
+	err := fmt.Errorf("no trackers to scrape")
+	for _, announce := range announceList {
+		var results map[[20]byte]ScrapeResult
+		results, err = ScrapeTracker(announce, tf.InfoHash)
+		if err != nil {
+			continue
+		}
+		result, ok := results[tf.InfoHash]
+		if !ok {
+			err = fmt.Errorf("tracker %s does not know torrent %x", announce, tf.InfoHash)
+			continue
+		}
+		return result, nil
+	}
+	return ScrapeResult{}, err
+}
@@ -0,0 +1,257 @@
+package alice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage persists torrent data as pieces pass the integrity check.
+//
+// Offsets passed to ReadAt and WriteAt are relative to the beginning of
+// the piece at the given index.
+type Storage interface {
+	ReadAt(buf []byte, index, begin int) (int, error)
+	WriteAt(buf []byte, index, begin int) (int, error)
+	MarkComplete(index int) error
+	Close() error
+}
+
+// Creates Storage for the torrent with its data located at outputPath.
+type StorageFunc func(tf *TorrentFile, outputPath string) (Storage, error)
+
+// Storage writing torrent data directly into output file(s).
+type fileStorage struct {
+	torrentFile *TorrentFile
+	outputPath  string
+	readOnly    bool // existing files are only read
+	mu          sync.Mutex
+	files       []*os.File // opened lazily
+}
+
+func NewFileStorage(tf *TorrentFile, outputPath string) (Storage, error) {
+	fs := &fileStorage{
+		torrentFile: tf,
+		outputPath:  outputPath,
+		files:       make([]*os.File, len(tf.Files)),
+	}
+
+	// create all files upfront so that empty files exist as well
+	for i, f := range tf.Files {
+		if f.Padding {
+			continue
+		}
+		_, err := fs.open(i)
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+// Storage reading data of existing file(s), used to hash them.
+func newReadOnlyFileStorage(tf *TorrentFile, outputPath string) *fileStorage {
+	return &fileStorage{
+		torrentFile: tf,
+		outputPath:  outputPath,
+		readOnly:    true,
+		files:       make([]*os.File, len(tf.Files)),
+	}
+}
+
+func (fs *fileStorage) open(index int) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.files[index] != nil {
+		return fs.files[index], nil
+	}
+
+	f := fs.torrentFile.Files[index]
+	path := fs.torrentFile.filePath(fs.outputPath, f)
+	if fs.readOnly {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fs.files[index] = file
+		return file, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs.files[index] = file
+	return file, nil
+}
+
+// Resolve piece relative range into per-file segments.
+func (fs *fileStorage) segments(index, begin, length int) ([]fileSegment, error) {
+	pieceBegin, pieceEnd := calcPieceBounds(fs.torrentFile, index)
+	if begin < 0 || pieceBegin+begin+length > pieceEnd {
+		err := fmt.Errorf("range [%d, %d) out of bounds for piece %d", begin, begin+length, index)
+		return nil, err
+	}
+	return fs.torrentFile.fileSegments(pieceBegin+begin, pieceBegin+begin+length), nil
+}
+
+func (fs *fileStorage) ReadAt(buf []byte, index, begin int) (int, error) {
+	segments, err := fs.segments(index, begin, len(buf))
+	if err != nil {
+		return 0, err
+	}
+
+	if !coversRange(segments, len(buf)) {
+		// padding is not stored and reads as zeros
+		copy(buf, make([]byte, len(buf)))
+	}
+
+	n := 0
+	for _, s := range segments {
+		file, err := fs.open(s.file)
+		if err != nil {
+			return n, err
+		}
+		read, err := file.ReadAt(buf[s.begin:s.begin+s.length], int64(s.offset))
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(buf), nil
+}
+
+func (fs *fileStorage) WriteAt(buf []byte, index, begin int) (int, error) {
+	if fs.readOnly {
+		return 0, fmt.Errorf("storage of %s is read-only", fs.outputPath)
+	}
+	segments, err := fs.segments(index, begin, len(buf))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range segments {
+		file, err := fs.open(s.file)
+		if err != nil {
+			return n, err
+		}
+		written, err := file.WriteAt(buf[s.begin:s.begin+s.length], int64(s.offset))
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	// padding is not stored but counts as written
+	return len(buf), nil
+}
+
+// Check if segments cover the whole range of the given length.
+func coversRange(segments []fileSegment, length int) bool {
+	covered := 0
+	for _, s := range segments {
+		covered += s.length
+	}
+	return covered == length
+}
+
+func (fs *fileStorage) MarkComplete(index int) error {
+	return nil
+}
+
+// Flush written data of all open files to disk.
+func (fs *fileStorage) sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, file := range fs.files {
+		if file == nil {
+			continue
+		}
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *fileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var firstErr error
+	for i, file := range fs.files {
+		if file == nil {
+			continue
+		}
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		fs.files[i] = nil
+	}
+	return firstErr
+}
+
+// Storage keeping the whole torrent data in memory.
+type memoryStorage struct {
+	torrentFile *TorrentFile
+	mu          sync.RWMutex
+	buffer      []byte
+	completed   Bitfield
+}
+
+func NewMemoryStorage(tf *TorrentFile, outputPath string) (Storage, error) {
+	return &memoryStorage{
+		torrentFile: tf,
+		buffer:      make([]byte, tf.Length),
+		completed:   make(Bitfield, (tf.numPieces()+7)/8),
+	}, nil
+}
+
+func (ms *memoryStorage) bounds(index, begin, length int) (int, int, error) {
+	pieceBegin, pieceEnd := calcPieceBounds(ms.torrentFile, index)
+	if begin < 0 || pieceBegin+begin+length > pieceEnd {
+		err := fmt.Errorf("range [%d, %d) out of bounds for piece %d", begin, begin+length, index)
+		return 0, 0, err
+	}
+	return pieceBegin + begin, pieceBegin + begin + length, nil
+}
+
+func (ms *memoryStorage) ReadAt(buf []byte, index, begin int) (int, error) {
+	from, to, err := ms.bounds(index, begin, len(buf))
+	if err != nil {
+		return 0, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return copy(buf, ms.buffer[from:to]), nil
+}
+
+func (ms *memoryStorage) WriteAt(buf []byte, index, begin int) (int, error) {
+	from, to, err := ms.bounds(index, begin, len(buf))
+	if err != nil {
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copy(ms.buffer[from:to], buf), nil
+}
+
+func (ms *memoryStorage) MarkComplete(index int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.completed.setPiece(index)
+	return nil
+}
+
+func (ms *memoryStorage) Close() error {
+	return nil
+}
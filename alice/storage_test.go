@@ -0,0 +1,207 @@
+package alice
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Torrent of three files with a padding file aligning the second file to
+// a piece boundary:
+//
+//	piece 0: a (100) + padding (156)
+//	piece 1: b [0, 256)
+//	piece 2: b [256, 300) + c (10)
+func newTestTorrentFile() *TorrentFile {
+	return &TorrentFile{
+		Name:        "test",
+		PieceLength: 256,
+		Length:      566,
+		PieceHashes: make([][20]byte, 3),
+		Files: []FileInfo{
+			{Path: []string{"a"}, Length: 100, Offset: 0},
+			{Path: []string{".pad", "156"}, Length: 156, Offset: 100, Padding: true},
+			{Path: []string{"dir", "b"}, Length: 300, Offset: 256},
+			{Path: []string{"c"}, Length: 10, Offset: 556},
+		},
+	}
+}
+
+// Random torrent data with zeros in place of padding.
+func newTestData(tf *TorrentFile) []byte {
+	data := make([]byte, tf.Length)
+	rand.Read(data)
+	for _, f := range tf.Files {
+		if f.Padding {
+			copy(data[f.Offset:f.Offset+f.Length], make([]byte, f.Length))
+		}
+	}
+	return data
+}
+
+// Write every piece in two writes split at the given piece offset.
+func writePieces(t *testing.T, s Storage, tf *TorrentFile, data []byte, split int) {
+	for index := 0; index < tf.numPieces(); index++ {
+		begin, end := calcPieceBounds(tf, index)
+		piece := data[begin:end]
+		if split > len(piece) {
+			split = len(piece)
+		}
+		for _, r := range [][2]int{{0, split}, {split, len(piece)}} {
+			n, err := s.WriteAt(piece[r[0]:r[1]], index, r[0])
+			if err != nil {
+				t.Fatalf("WriteAt piece %d [%d, %d): %v", index, r[0], r[1], err)
+			}
+			if n != r[1]-r[0] {
+				t.Fatalf("WriteAt piece %d wrote %d bytes, want %d", index, n, r[1]-r[0])
+			}
+		}
+		err := s.MarkComplete(index)
+		if err != nil {
+			t.Fatalf("MarkComplete(%d): %v", index, err)
+		}
+	}
+}
+
+func checkPieces(t *testing.T, s Storage, tf *TorrentFile, data []byte) {
+	for index := 0; index < tf.numPieces(); index++ {
+		begin, end := calcPieceBounds(tf, index)
+		// padding has to be zeroed
+		buf := bytes.Repeat([]byte{0xff}, end-begin)
+		n, err := s.ReadAt(buf, index, 0)
+		if err != nil {
+			t.Fatalf("ReadAt piece %d: %v", index, err)
+		}
+		if n != len(buf) {
+			t.Fatalf("ReadAt piece %d read %d bytes, want %d", index, n, len(buf))
+		}
+		if !bytes.Equal(buf, data[begin:end]) {
+			t.Fatalf("piece %d read back differs", index)
+		}
+	}
+
+	// block spanning the end of b and c
+	buf := make([]byte, 20)
+	_, err := s.ReadAt(buf, 2, 34)
+	if err != nil {
+		t.Fatalf("ReadAt across files: %v", err)
+	}
+	if !bytes.Equal(buf, data[512+34:512+54]) {
+		t.Fatalf("block across files read back differs")
+	}
+}
+
+func checkOutOfBounds(t *testing.T, s Storage) {
+	buf := make([]byte, 16)
+	if _, err := s.ReadAt(buf, 2, 50); err == nil {
+		t.Errorf("ReadAt past the last piece succeeded")
+	}
+	if _, err := s.WriteAt(buf, 0, 250); err == nil {
+		t.Errorf("WriteAt past the piece end succeeded")
+	}
+	if _, err := s.ReadAt(buf, 0, -1); err == nil {
+		t.Errorf("ReadAt at negative offset succeeded")
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	tf := newTestTorrentFile()
+	data := newTestData(tf)
+	outputPath := t.TempDir()
+
+	s, err := NewFileStorage(tf, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePieces(t, s, tf, data, 150)
+	checkPieces(t, s, tf, data)
+	checkOutOfBounds(t, s)
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range tf.Files {
+		path := tf.filePath(outputPath, f)
+		content, err := os.ReadFile(path)
+		if f.Padding {
+			if !os.IsNotExist(err) {
+				t.Errorf("padding file %s was created", path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, data[f.Offset:f.Offset+f.Length]) {
+			t.Errorf("file %s differs", path)
+		}
+	}
+
+	// data is read back from existing files
+	s, err = NewFileStorage(tf, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkPieces(t, s, tf, data)
+}
+
+func TestFileStorageSingleFile(t *testing.T) {
+	tf := &TorrentFile{
+		Name:        "single",
+		PieceLength: 64,
+		Length:      100,
+		PieceHashes: make([][20]byte, 2),
+		Files:       []FileInfo{{Length: 100}},
+	}
+	data := newTestData(tf)
+	outputPath := filepath.Join(t.TempDir(), "single")
+
+	s, err := NewFileStorage(tf, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePieces(t, s, tf, data, 10)
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Errorf("output file differs")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	tf := newTestTorrentFile()
+	data := newTestData(tf)
+
+	s, err := NewMemoryStorage(tf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ms := s.(*memoryStorage)
+	for index := 0; index < tf.numPieces(); index++ {
+		if ms.completed.hasPiece(index) {
+			t.Errorf("piece %d completed before MarkComplete", index)
+		}
+	}
+
+	writePieces(t, s, tf, data, 100)
+	checkPieces(t, s, tf, data)
+	checkOutOfBounds(t, s)
+	for index := 0; index < tf.numPieces(); index++ {
+		if !ms.completed.hasPiece(index) {
+			t.Errorf("piece %d not completed after MarkComplete", index)
+		}
+	}
+}
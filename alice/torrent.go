@@ -1,17 +1,39 @@
 package alice
 
+import "sync"
+
 type Torrent struct {
 	torrentPath      string
 	outputPath       string
 	torrentFile      *TorrentFile
 	peerID           [20]byte
+	key              []byte // sent with every announce of this session
 	trackers         []string
 	peers            chan []Peer
+	initialPeers     []Peer        // peers known upfront (magnet x.pe)
+	metadataPeers    []Peer        // peers received while fetching metadata
+	incoming         chan *Channel // accepted incoming connections
+	listener         *peerListener // nil if not listening
+	port             int           // listen port, 0 if not listening
 	config           Config
 	piecesDone       int
 	activePeers      int
 	finishedDownload bool
-	outputBuffer     []byte
+	storage          Storage
+	picker           *piecePicker
+	rechokeNow       chan struct{}     // wakes the choker early
+	completed        chan struct{}     // closed once Download returns
+	stopping         chan struct{}     // closed by OutputToFile
+	trackersDone     chan struct{}     // closed once trackers are no longer announced to
+	uploaded         int               // piece data sent to peers
+	downloaded       int               // piece data received from peers
+	announced        []string          // trackers that were sent the started event
+	trackerIDs       map[string]string // tracker id received from each tracker
+	mu               sync.RWMutex
+	bitfield         Bitfield              // verified pieces
+	channels         map[*Channel]struct{} // connected peers
+	closing          bool                  // no peers are accepted anymore
+	serving          sync.WaitGroup        // connected peers (might use storage)
 }
 
 func NewTorrent(torrentPath, outputPath string) *Torrent {
@@ -19,9 +41,152 @@ func NewTorrent(torrentPath, outputPath string) *Torrent {
 		torrentPath: torrentPath,
 		outputPath:  outputPath,
 		peerID:      generatePeerID(),
+		key:         generateRandomID(4),
 		peers:       make(chan []Peer),
+		incoming:    make(chan *Channel),
+		rechokeNow:  make(chan struct{}, 1),
+		completed:   make(chan struct{}),
+		stopping:    make(chan struct{}),
+		trackerIDs:  make(map[string]string),
 		config:      DefaultConfig,
 		piecesDone:  0,
 		activePeers: 0,
+		channels:    make(map[*Channel]struct{}),
+	}
+}
+
+// Check if piece at the given index is verified and stored.
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.bitfield.hasPiece(index)
+}
+
+func (t *Torrent) bitfieldCopy() Bitfield {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	bf := make(Bitfield, len(t.bitfield))
+	copy(bf, t.bitfield)
+	return bf
+}
+
+// Mark piece as verified and announce it to all connected peers.
+func (t *Torrent) completePiece(index int) {
+	t.mu.Lock()
+	t.bitfield.setPiece(index)
+	channels := make([]*Channel, 0, len(t.channels))
+	for ch := range t.channels {
+		channels = append(channels, ch)
+	}
+	t.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.sendHave(index)
+	}
+}
+
+// Register connected peer, returns false if it is already connected or
+// the torrent is closing.
+//
+// Peers are the same if they have the same peer ID or listen address, the
+// connection of an incoming peer comes from a different port.
+func (t *Torrent) addChannel(ch *Channel) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing || ch.remotePeerID == t.peerID {
+		return false
+	}
+	addr := ch.listenAddr().String()
+	for other := range t.channels {
+		if other.remotePeerID == ch.remotePeerID || other.listenAddr().String() == addr {
+			return false
+		}
+	}
+	t.channels[ch] = struct{}{}
+	t.activePeers = len(t.channels)
+	t.serving.Add(1)
+	// peer might have become interested before it was added
+	if ch.isInterested() {
+		t.requestRechoke()
+	}
+	return true
+}
+
+func (t *Torrent) removeChannel(ch *Channel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.channels, ch)
+	t.activePeers = len(t.channels)
+	t.serving.Done()
+}
+
+// Disconnect all peers and wait until they no longer use the storage.
+func (t *Torrent) closeChannels() {
+	t.mu.Lock()
+	t.closing = true
+	channels := make([]*Channel, 0, len(t.channels))
+	for ch := range t.channels {
+		channels = append(channels, ch)
+	}
+	t.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.close()
+	}
+	t.serving.Wait()
+}
+
+func (t *Torrent) isConnected(peer Peer) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for ch := range t.channels {
+		if ch.listenAddr().String() == peer.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Torrent) addUploaded(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uploaded += n
+}
+
+func (t *Torrent) addDownloaded(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downloaded += n
+}
+
+// Torrent file, replaced by setMetadata once metadata of a magnet link is
+// fetched.
+func (t *Torrent) metainfo() *TorrentFile {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.torrentFile
+}
+
+// Transfer statistics reported to trackers.
+//
+// Left is unknown (reported as 1) until metadata of a magnet link is
+// fetched and equals the length of all files until existing data is
+// verified. Padding does not count.
+func (t *Torrent) stats() (uploaded, downloaded, left int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tf := t.torrentFile
+	if tf.Files == nil {
+		return t.uploaded, t.downloaded, 1
+	}
+	for index := 0; index < tf.numPieces(); index++ {
+		if t.bitfield.hasPiece(index) {
+			continue
+		}
+		begin, end := calcPieceBounds(tf, index)
+		for _, s := range tf.fileSegments(begin, end) {
+			left += s.length
+		}
 	}
+	return t.uploaded, t.downloaded, left
 }
@@ -1,22 +1,52 @@
 package alice
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
+	"math/rand"
 	"os"
-
-	bencode "github.com/jackpal/bencode-go"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type TorrentFile struct {
 	Announce     string
-	AnnounceList []string
+	AnnounceList [][]string // tiers of trackers (BEP 12), nil if not present
 	InfoHash     [20]byte
 	PieceLength  int
 	PieceHashes  [][20]byte
 	Length       int
 	Name         string
+	Files        []FileInfo
+	Private      bool     // peers only come from trackers (BEP 27)
+	URLList      []string // web seeds (BEP 19)
+	HTTPSeeds    []string // seed scripts serving pieces (BEP 17)
+
+	// BitTorrent v2 (BEP 52), hybrid torrents carry v1 and v2 metadata.
+	// InfoHash of v2-only torrents is the truncated InfoHashV2.
+	MetaVersion int                     // 2 for v2 and hybrid torrents
+	InfoHashV2  [32]byte                // SHA-256 of the info dictionary
+	PieceLayers map[[32]byte][][32]byte // piece layer of files by pieces root
+
+	RawInfo   []byte                 // bencoded info dictionary, hashed as is
+	Extra     map[string]interface{} // keys of the metainfo not modeled above
+	InfoExtra map[string]interface{} // keys of the info dictionary not modeled above
+}
+
+// Describes a single file within the torrent data.
+//
+// Single-file torrents have exactly one FileInfo with an empty Path.
+// Multi-file torrents list their files in order, each with a Path
+// relative to the directory named after the torrent.
+type FileInfo struct {
+	Path   []string // path components, preferring path.utf-8
+	Length int      // length of the file in bytes
+	Offset int      // offset of the file within the torrent data
+
+	PiecesRoot [32]byte // merkle root of the file (v2), zero if empty
+	Padding    bool     // only aligns the next file to a piece (BEP 47)
 }
 
 type bencodeInfo struct {
@@ -24,14 +54,20 @@ type bencodeInfo struct {
 	Pieces      string            `bencode:"pieces"`
 	Length      int               `bencode:"length,omitempty"`
 	Name        string            `bencode:"name"`
-	Private     bool              `bencode:"private,omitempty"`
+	Private     int               `bencode:"private,omitempty"`
 	Source      string            `bencode:"source,omitempty"`
 	Files       []bencodeFileInfo `bencode:"files,omitempty"`
+	MetaVersion int               `bencode:"meta version,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce     string      `bencode:"announce"`
+	Announce     string      `bencode:"announce,omitempty"`
 	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	URLList      []string    `bencode:"url-list,omitempty"`
+	HTTPSeeds    []string    `bencode:"httpseeds,omitempty"`
 	Info         bencodeInfo `bencode:"info"`
 }
 
@@ -39,37 +75,108 @@ type bencodeFileInfo struct {
 	Length   int      `bencode:"length"`
 	Path     []string `bencode:"path"`
 	PathUTF8 []string `bencode:"path.utf-8,omitempty"`
+	Attr     string   `bencode:"attr,omitempty"`
 }
 
+// Keys of bencodeTorrent and bencodeInfo, others are kept as extra keys.
+var (
+	torrentKeys = []string{"announce", "announce-list", "comment", "created by", "creation date", "url-list", "httpseeds", "info", "piece layers"}
+	infoKeys    = []string{"piece length", "pieces", "length", "name", "private", "source", "files", "meta version", "file tree"}
+)
+
 func (t *Torrent) ParseTorrent() (*TorrentFile, error) {
-	file, err := os.Open(t.torrentPath)
+	data, err := os.ReadFile(t.torrentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tf, err := parseTorrent(data)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	t.torrentFile = tf
+	return tf, nil
+}
 
-	bto := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bto)
+// Parse bencoded metainfo (.torrent file contents).
+//
+// Info hash is calculated from the info dictionary exactly as it appears
+// in the metainfo, so keys unknown to bencodeInfo still count.
+func parseTorrent(data []byte) (*TorrentFile, error) {
+	metainfo, err := decodeDict(data)
 	if err != nil {
 		return nil, err
 	}
+	rawInfo, err := rawDictValue(data, "info")
+	if err != nil {
+		return nil, err
+	}
+	info, ok := metainfo["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("info of the metainfo is not a dictionary")
+	}
 
-	tf, err := bto.toTorrentFile()
+	bto := newBencodeTorrent(metainfo)
+	tf, err := bto.toTorrentFile(info, rawInfo)
 	if err != nil {
 		return nil, err
 	}
-	t.torrentFile = tf
+	tf.Extra = unknownKeys(metainfo, torrentKeys)
+	if tf.hasV2() {
+		tf.PieceLayers, err = parsePieceLayers(metainfo, tf)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return tf, nil
 }
 
-func (binfo *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *binfo)
-	if err != nil {
-		return [20]byte{}, err
+// Typed view of the decoded metainfo, values of unexpected type are left
+// empty.
+func newBencodeTorrent(metainfo map[string]interface{}) bencodeTorrent {
+	bto := bencodeTorrent{
+		Announce:     dictString(metainfo, "announce"),
+		Comment:      dictString(metainfo, "comment"),
+		CreatedBy:    dictString(metainfo, "created by"),
+		CreationDate: int64(dictInt(metainfo, "creation date")),
+		URLList:      parseURLList(metainfo),
+		HTTPSeeds:    dictStrings(metainfo, "httpseeds"),
+	}
+	if tiers, ok := metainfo["announce-list"].([]interface{}); ok {
+		bto.AnnounceList = make([][]string, 0, len(tiers))
+		for _, tier := range tiers {
+			list, _ := tier.([]interface{})
+			bto.AnnounceList = append(bto.AnnounceList, stringList(list))
+		}
+	}
+	info, _ := metainfo["info"].(map[string]interface{})
+	bto.Info = newBencodeInfo(info)
+	return bto
+}
+
+func newBencodeInfo(info map[string]interface{}) bencodeInfo {
+	binfo := bencodeInfo{
+		PieceLength: dictInt(info, "piece length"),
+		Pieces:      dictString(info, "pieces"),
+		Length:      dictInt(info, "length"),
+		Name:        dictString(info, "name"),
+		Private:     dictInt(info, "private"),
+		Source:      dictString(info, "source"),
+		MetaVersion: dictInt(info, "meta version"),
+	}
+	if files, ok := info["files"].([]interface{}); ok {
+		binfo.Files = make([]bencodeFileInfo, len(files))
+		for i, value := range files {
+			f, _ := value.(map[string]interface{})
+			binfo.Files[i] = bencodeFileInfo{
+				Length:   dictInt(f, "length"),
+				Path:     dictStrings(f, "path"),
+				PathUTF8: dictStrings(f, "path.utf-8"),
+				Attr:     dictString(f, "attr"),
+			}
+		}
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	return binfo
 }
 
 func (binfo *bencodeInfo) generatePieceHashes() ([][20]byte, error) {
@@ -102,40 +209,453 @@ func (bto *bencodeTorrent) totalLength() (length int) {
 	return
 }
 
-func flattenAnnounceList(announceList [][]string) []string {
-	flat := make([]string, len(announceList))
-	for i := 0; i < len(announceList); i++ {
-		flat[i] = announceList[i][0]
+// Check that a path component cannot escape the output directory.
+func validPathComponent(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
 	}
-	return flat
+	return !strings.ContainsAny(name, "/\\")
 }
 
-func (bto *bencodeTorrent) toTorrentFile() (*TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return nil, err
+func (bto *bencodeTorrent) fileList() ([]FileInfo, error) {
+	if !validPathComponent(bto.Info.Name) {
+		return nil, fmt.Errorf("invalid torrent name %q", bto.Info.Name)
 	}
 
-	pieceHashes, err := bto.Info.generatePieceHashes()
-	if err != nil {
-		return nil, err
+	if bto.Info.Files == nil {
+		return []FileInfo{{Length: bto.Info.Length}}, nil
 	}
 
-	var announceList []string
-	if bto.AnnounceList == nil {
-		announceList = nil
-	} else {
-		announceList = flattenAnnounceList(bto.AnnounceList)
+	files := make([]FileInfo, len(bto.Info.Files))
+	offset := 0
+	for i, f := range bto.Info.Files {
+		path := f.Path
+		if len(f.PathUTF8) > 0 {
+			path = f.PathUTF8
+		}
+		if len(path) == 0 {
+			return nil, fmt.Errorf("file %d has an empty path", i)
+		}
+		for _, name := range path {
+			if !validPathComponent(name) {
+				return nil, fmt.Errorf("file %d has invalid path component %q", i, name)
+			}
+		}
+		files[i] = FileInfo{
+			Path:    path,
+			Length:  f.Length,
+			Offset:  offset,
+			Padding: strings.Contains(f.Attr, "p"),
+		}
+		offset += f.Length
+	}
+	return files, nil
+}
+
+// Check if torrent data is spread over multiple files.
+func (tf *TorrentFile) isMultiFile() bool {
+	return len(tf.Files) != 1 || len(tf.Files[0].Path) != 0
+}
+
+// Resolve location of the file on disk.
+//
+// Single-file torrents are written to outputPath itself while multi-file
+// torrents are written to a directory named after the torrent in outputPath.
+func (tf *TorrentFile) filePath(outputPath string, f FileInfo) string {
+	if !tf.isMultiFile() {
+		return outputPath
+	}
+	return filepath.Join(append([]string{outputPath, tf.Name}, f.Path...)...)
+}
+
+// Drop empty trackers and tiers and shuffle trackers within each tier.
+//
+// Trackers are shuffled once when the torrent is loaded, successful
+// trackers are later moved to the front of their tier.
+func shuffleAnnounceList(announceList [][]string) [][]string {
+	var tiers [][]string
+	for _, tier := range announceList {
+		var trackers []string
+		for _, announce := range tier {
+			if announce != "" {
+				trackers = append(trackers, announce)
+			}
+		}
+		if len(trackers) == 0 {
+			continue
+		}
+		rand.Shuffle(len(trackers), func(i, j int) {
+			trackers[i], trackers[j] = trackers[j], trackers[i]
+		})
+		tiers = append(tiers, trackers)
+	}
+	return tiers
+}
+
+// Build torrent file from the decoded metainfo, its decoded info
+// dictionary and the raw info dictionary it was decoded from.
+//
+// Hybrid torrents are described by both v1 and v2 keys, the v1 info hash
+// identifies them.
+func (bto *bencodeTorrent) toTorrentFile(info map[string]interface{}, rawInfo []byte) (*TorrentFile, error) {
+	var announceList [][]string
+	if bto.AnnounceList != nil {
+		announceList = shuffleAnnounceList(bto.AnnounceList)
 	}
 
 	tf := TorrentFile{
 		Announce:     bto.Announce,
 		AnnounceList: announceList,
-		InfoHash:     infoHash,
-		PieceHashes:  pieceHashes,
 		PieceLength:  bto.Info.PieceLength,
-		Length:       bto.totalLength(),
 		Name:         bto.Info.Name,
+		URLList:      bto.URLList,
+		HTTPSeeds:    bto.HTTPSeeds,
+		Private:      bto.Info.Private == 1,
+		MetaVersion:  bto.Info.MetaVersion,
+		RawInfo:      rawInfo,
+		InfoExtra:    unknownKeys(info, infoKeys),
+	}
+
+	switch bto.Info.MetaVersion {
+	case 0, 1:
+	case 2:
+		if bto.Info.Pieces == "" {
+			err := tf.setFileTree(info, rawInfo)
+			if err != nil {
+				return nil, err
+			}
+			return &tf, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported meta version %d", bto.Info.MetaVersion)
+	}
+
+	tf.InfoHash = sha1.Sum(rawInfo)
+	var err error
+	tf.PieceHashes, err = bto.Info.generatePieceHashes()
+	if err != nil {
+		return nil, err
+	}
+	tf.Files, err = bto.fileList()
+	if err != nil {
+		return nil, err
+	}
+	tf.Length = bto.totalLength()
+
+	if tf.MetaVersion == 2 {
+		err := tf.setFileTree(info, rawInfo)
+		if err != nil {
+			return nil, err
+		}
 	}
 	return &tf, nil
 }
+
+// Read the v2 file tree of the info dictionary (BEP 52).
+//
+// Files of v2-only torrents are laid out in file tree order, each one
+// starting at a piece boundary. Files of hybrid torrents are already laid
+// out by the v1 file list and only get their pieces roots.
+func (tf *TorrentFile) setFileTree(info map[string]interface{}, rawInfo []byte) error {
+	if tf.PieceLength < merkleBlockSize || tf.PieceLength&(tf.PieceLength-1) != 0 {
+		return fmt.Errorf("piece length %d of v2 torrent is not a power of two of at least 16kB", tf.PieceLength)
+	}
+	if !validPathComponent(tf.Name) {
+		return fmt.Errorf("invalid torrent name %q", tf.Name)
+	}
+
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("v2 torrent is missing file tree")
+	}
+	files, err := walkFileTree(tree, nil, nil)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("v2 torrent has an empty file tree")
+	}
+	// single file is at the root of the tree under the torrent name
+	if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == tf.Name {
+		files[0].Path = nil
+	}
+	tf.InfoHashV2 = sha256.Sum256(rawInfo)
+
+	if tf.PieceHashes != nil {
+		return tf.matchFileTree(files)
+	}
+
+	copy(tf.InfoHash[:], tf.InfoHashV2[:])
+	offset := 0
+	for i := range files {
+		if files[i].Length > 0 && offset%tf.PieceLength != 0 {
+			offset += tf.PieceLength - offset%tf.PieceLength
+		}
+		files[i].Offset = offset
+		offset += files[i].Length
+	}
+	tf.Files = files
+	tf.Length = offset
+	return nil
+}
+
+// Flatten file tree into files in path order.
+//
+// File is a dictionary with an empty key holding its length and the
+// merkle root of its data.
+func walkFileTree(node map[string]interface{}, path []string, files []FileInfo) ([]FileInfo, error) {
+	if value, ok := node[""]; ok {
+		leaf, ok := value.(map[string]interface{})
+		if !ok || len(path) == 0 {
+			return nil, fmt.Errorf("invalid file tree entry %q", strings.Join(path, "/"))
+		}
+		f := FileInfo{Path: path, Length: dictInt(leaf, "length")}
+		root := dictString(leaf, "pieces root")
+		if f.Length < 0 || (f.Length > 0 && len(root) != len(f.PiecesRoot)) {
+			return nil, fmt.Errorf("file %q has invalid length or pieces root", strings.Join(path, "/"))
+		}
+		copy(f.PiecesRoot[:], root)
+		return append(files, f), nil
+	}
+
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validPathComponent(name) {
+			return nil, fmt.Errorf("file tree has invalid path component %q", name)
+		}
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("file tree entry %q is not a dictionary", name)
+		}
+		var err error
+		files, err = walkFileTree(child, append(path[:len(path):len(path)], name), files)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Attach pieces roots to files of a hybrid torrent, v1 and v2 have to
+// describe the same files aligned to pieces.
+func (tf *TorrentFile) matchFileTree(files []FileInfo) error {
+	roots := make(map[string]FileInfo, len(files))
+	for _, f := range files {
+		roots[strings.Join(f.Path, "/")] = f
+	}
+
+	matched := 0
+	for i, f := range tf.Files {
+		if f.Padding {
+			continue
+		}
+		v2, ok := roots[strings.Join(f.Path, "/")]
+		if !ok || v2.Length != f.Length {
+			return fmt.Errorf("file %d of hybrid torrent does not match its file tree", i)
+		}
+		if f.Length > 0 && f.Offset%tf.PieceLength != 0 {
+			return fmt.Errorf("file %d of hybrid torrent is not aligned to a piece", i)
+		}
+		tf.Files[i].PiecesRoot = v2.PiecesRoot
+		matched++
+	}
+	if matched != len(files) {
+		return fmt.Errorf("hybrid torrent has %d files but its file tree %d", matched, len(files))
+	}
+	return nil
+}
+
+// Read url-list of the metainfo, either a single URL or a list of them.
+func parseURLList(metainfo map[string]interface{}) []string {
+	var urls []string
+	switch value := metainfo["url-list"].(type) {
+	case string:
+		if value != "" {
+			urls = append(urls, value)
+		}
+	case []interface{}:
+		for _, v := range value {
+			if u, ok := v.(string); ok && u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+	return urls
+}
+
+// Read piece layers of the metainfo and check them against the pieces
+// roots. Files no longer than a piece have no piece layer.
+func parsePieceLayers(metainfo map[string]interface{}, tf *TorrentFile) (map[[32]byte][][32]byte, error) {
+	values, _ := metainfo["piece layers"].(map[string]interface{})
+
+	layers := make(map[[32]byte][][32]byte)
+	for i, f := range tf.Files {
+		if f.Padding || f.Length <= tf.PieceLength {
+			continue
+		}
+		value, ok := values[string(f.PiecesRoot[:])].(string)
+		if !ok || len(value)%32 != 0 {
+			return nil, fmt.Errorf("piece layer of file %d is missing or malformed", i)
+		}
+		layer := make([][32]byte, len(value)/32)
+		for j := range layer {
+			copy(layer[j][:], value[j*32:])
+		}
+		if !tf.validPieceLayer(f, layer) {
+			return nil, fmt.Errorf("piece layer of file %d does not match its pieces root", i)
+		}
+		layers[f.PiecesRoot] = layer
+	}
+	return layers, nil
+}
+
+// Height of the piece layer above the leaves of a file merkle tree.
+func (tf *TorrentFile) pieceLayerHeight() int {
+	return log2(tf.PieceLength / merkleBlockSize)
+}
+
+// Check that the layer has a hash for every piece of the file and that
+// they hash to its pieces root.
+func (tf *TorrentFile) validPieceLayer(f FileInfo, layer [][32]byte) bool {
+	numPieces := (f.Length + tf.PieceLength - 1) / tf.PieceLength
+	if len(layer) != numPieces {
+		return false
+	}
+	root := merkleRoot(layer, nextPowerOfTwo(numPieces), padHash(tf.pieceLayerHeight()))
+	return root == f.PiecesRoot
+}
+
+// Check if the torrent has v1 piece hashes.
+func (tf *TorrentFile) hasV1() bool {
+	return tf.PieceHashes != nil
+}
+
+// Check if the torrent is a v2 or hybrid torrent (also known for magnet
+// links with a v2 info hash before metadata is fetched).
+func (tf *TorrentFile) hasV2() bool {
+	return tf.InfoHashV2 != [32]byte{}
+}
+
+// Info hashes of the swarms the torrent joins, hybrid torrents are shared
+// in the v1 swarm and in the v2 swarm under the truncated v2 info hash.
+func (tf *TorrentFile) infoHashes() [][20]byte {
+	infoHashes := [][20]byte{tf.InfoHash}
+	var truncated [20]byte
+	copy(truncated[:], tf.InfoHashV2[:])
+	if tf.hasV2() && truncated != tf.InfoHash {
+		infoHashes = append(infoHashes, truncated)
+	}
+	return infoHashes
+}
+
+// Number of pieces, 0 until metadata is known.
+func (tf *TorrentFile) numPieces() int {
+	if tf.hasV1() {
+		return len(tf.PieceHashes)
+	}
+	if tf.PieceLength == 0 {
+		return 0
+	}
+	return (tf.Length + tf.PieceLength - 1) / tf.PieceLength
+}
+
+// Find the file that the piece belongs to in v2 layout, false if the piece
+// only holds padding.
+func (tf *TorrentFile) pieceFile(index int) (FileInfo, bool) {
+	begin := index * tf.PieceLength
+	for _, f := range tf.Files {
+		if !f.Padding && f.Offset <= begin && begin < f.Offset+f.Length {
+			return f, true
+		}
+	}
+	return FileInfo{}, false
+}
+
+// Check piece against its v1 hash and against the merkle tree of its file.
+//
+// Hybrid torrents without the piece layer of a file (fetched metadata)
+// are only checked against the v1 hash.
+func (tf *TorrentFile) checkPiece(index int, buf []byte) error {
+	if tf.hasV1() {
+		err := checkIntegrity(index, tf.PieceHashes[index], buf)
+		if err != nil {
+			return err
+		}
+	}
+	if !tf.hasV2() {
+		return nil
+	}
+	f, ok := tf.pieceFile(index)
+	if !ok {
+		return nil
+	}
+
+	// data past the end of the file is padding
+	begin := index * tf.PieceLength
+	if f.Offset+f.Length-begin < len(buf) {
+		buf = buf[:f.Offset+f.Length-begin]
+	}
+	leaves := blockHashes(buf)
+	var expected, hash [32]byte
+	if f.Length <= tf.PieceLength {
+		expected = f.PiecesRoot
+		hash = merkleRoot(leaves, nextPowerOfTwo(len(leaves)), [32]byte{})
+	} else {
+		layer, ok := tf.PieceLayers[f.PiecesRoot]
+		if !ok {
+			if tf.hasV1() {
+				return nil
+			}
+			return fmt.Errorf("index %d has no piece layer to check against", index)
+		}
+		expected = layer[(begin-f.Offset)/tf.PieceLength]
+		hash = merkleRoot(leaves, tf.PieceLength/merkleBlockSize, [32]byte{})
+	}
+	if hash != expected {
+		return fmt.Errorf("index %d failed integrity check", index)
+	}
+	return nil
+}
+
+// Part of a torrent data range that falls within a single file.
+type fileSegment struct {
+	file   int // index into Files
+	offset int // offset within the file
+	begin  int // offset within the range
+	length int
+}
+
+// Split torrent data range [begin, end) into segments of individual files.
+//
+// Padding files and gaps between v2 files are not backed by any file and
+// are left out, they only hold zeros.
+func (tf *TorrentFile) fileSegments(begin, end int) []fileSegment {
+	var segments []fileSegment
+	for i, f := range tf.Files {
+		fileEnd := f.Offset + f.Length
+		if fileEnd <= begin || f.Length == 0 || f.Padding {
+			continue
+		}
+		if f.Offset >= end {
+			break
+		}
+		from, to := begin, end
+		if from < f.Offset {
+			from = f.Offset
+		}
+		if to > fileEnd {
+			to = fileEnd
+		}
+		segments = append(segments, fileSegment{
+			file:   i,
+			offset: from - f.Offset,
+			begin:  from - begin,
+			length: to - from,
+		})
+	}
+	return segments
+}
@@ -0,0 +1,205 @@
+package alice
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Concatenated v1 piece hashes of the test torrents, content is not
+// checked when parsing.
+var testPieces = "20:" + strings.Repeat("a", 20)
+
+func TestParseTorrentInfoHash(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     string
+		infoHash string
+	}{
+		{
+			"single file",
+			"d6:lengthi5e4:name5:a.txt12:piece lengthi16384e6:pieces" + testPieces + "e",
+			"7faf75b2447f88700c68f1eceda713cd90a0127a",
+		},
+		{
+			// re-encoding would sort the keys and change the hash
+			"unsorted keys",
+			"d4:name5:a.txt6:lengthi5e6:pieces" + testPieces + "12:piece lengthi16384ee",
+			"549e15310a24c86928810a04db2d546a3ad64396",
+		},
+		{
+			"unknown key",
+			"d6:lengthi5e4:name5:a.txt12:piece lengthi16384e6:pieces" + testPieces + "8:x-customi1ee",
+			"5df6c0bb745ee68ce2e086611ae69c76cb53e045",
+		},
+		{
+			"multiple files",
+			"d5:filesld6:lengthi3e4:pathl1:aeed6:lengthi2e4:pathl3:dir1:beee4:name3:dir12:piece lengthi16384e6:pieces" + testPieces + "e",
+			"2d026628bf089277211b200a19709d70741a07f6",
+		},
+	}
+	for _, test := range tests {
+		tf, err := parseTorrent([]byte("d8:announce16:http://tracker/a4:info" + test.info + "e"))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(tf.RawInfo) != test.info {
+			t.Errorf("%s: raw info %q, want %q", test.name, tf.RawInfo, test.info)
+		}
+		if infoHash := hex.EncodeToString(tf.InfoHash[:]); infoHash != test.infoHash {
+			t.Errorf("%s: info hash %s, want %s", test.name, infoHash, test.infoHash)
+		}
+		if tf.Length != 5 || tf.Announce != "http://tracker/a" {
+			t.Errorf("%s: length %d and announce %q, want 5 and http://tracker/a", test.name, tf.Length, tf.Announce)
+		}
+	}
+}
+
+func TestParseTorrentUnknownKeys(t *testing.T) {
+	data := "d8:announce16:http://tracker/a7:comment4:test" +
+		"4:infod6:lengthi5e4:name5:a.txt12:piece lengthi16384e6:pieces" + testPieces + "8:x-customl1:xee" +
+		"5:x-topi7ee"
+	tf, err := parseTorrent([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tf.Extra) != 1 || tf.Extra["x-top"] != int64(7) {
+		t.Errorf("extra keys %v, want only x-top", tf.Extra)
+	}
+	custom, ok := tf.InfoExtra["x-custom"].([]interface{})
+	if len(tf.InfoExtra) != 1 || !ok || len(custom) != 1 || custom[0] != "x" {
+		t.Errorf("extra info keys %v, want only x-custom", tf.InfoExtra)
+	}
+
+	tf, err = parseTorrent([]byte("d4:info" + "d6:lengthi5e4:name5:a.txt12:piece lengthi16384e6:pieces" + testPieces + "ee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tf.Extra != nil || tf.InfoExtra != nil {
+		t.Errorf("extra keys %v and %v of torrent without unknown keys", tf.Extra, tf.InfoExtra)
+	}
+}
+
+// File tree of a single file holding testV2Data.
+func testFileTree(t *testing.T) string {
+	root, err := hex.DecodeString(testV2Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "d5:a.txtd0:d6:lengthi32868e11:pieces root32:" + string(root) + "eee"
+}
+
+// Piece layers of the metainfo with the given hashes for the file.
+func testPieceLayers(t *testing.T, layer [][32]byte) string {
+	root, err := hex.DecodeString(testV2Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes strings.Builder
+	for _, hash := range layer {
+		hashes.Write(hash[:])
+	}
+	return "12:piece layersd32:" + string(root) + strconv.Itoa(hashes.Len()) + ":" + hashes.String() + "e"
+}
+
+func TestParseTorrentV2(t *testing.T) {
+	layer := blockHashes([]byte(testV2Data))
+	tests := []struct {
+		name       string
+		info       string
+		infoHash   string
+		infoHashV2 string
+		swarms     int
+	}{
+		{
+			"v2",
+			"d9:file tree" + testFileTree(t) + "12:meta versioni2e4:name5:a.txt12:piece lengthi16384ee",
+			"63537c2c9b6db1bf5876cec355627219e54d336c",
+			"63537c2c9b6db1bf5876cec355627219e54d336cbe42d6ae97016540d71a2187",
+			1,
+		},
+		{
+			"hybrid",
+			"d9:file tree" + testFileTree(t) + "6:lengthi32868e12:meta versioni2e4:name5:a.txt12:piece lengthi16384e" +
+				"6:pieces60:" + strings.Repeat("a", 60) + "e",
+			"8ccd1a47e97a367dbd67ae58cd2f08cffd54a768",
+			"0f693a5c960d056ed6436fa7484ad8067f22fac0c4d261485428403dea298845",
+			2,
+		},
+	}
+	for _, test := range tests {
+		tf, err := parseTorrent([]byte("d4:info" + test.info + testPieceLayers(t, layer) + "e"))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if infoHash := hex.EncodeToString(tf.InfoHash[:]); infoHash != test.infoHash {
+			t.Errorf("%s: info hash %s, want %s", test.name, infoHash, test.infoHash)
+		}
+		if infoHashV2 := hex.EncodeToString(tf.InfoHashV2[:]); infoHashV2 != test.infoHashV2 {
+			t.Errorf("%s: v2 info hash %s, want %s", test.name, infoHashV2, test.infoHashV2)
+		}
+		// hybrid torrents are in the v1 and the v2 swarm
+		infoHashes := tf.infoHashes()
+		if len(infoHashes) != test.swarms || hex.EncodeToString(infoHashes[len(infoHashes)-1][:]) != test.infoHashV2[:40] {
+			t.Errorf("%s: info hashes %x", test.name, infoHashes)
+		}
+
+		if len(tf.Files) != 1 || tf.Files[0].Path != nil || tf.Length != len(testV2Data) {
+			t.Errorf("%s: files %+v of length %d", test.name, tf.Files, tf.Length)
+		}
+		if hex.EncodeToString(tf.Files[0].PiecesRoot[:]) != testV2Root {
+			t.Errorf("%s: pieces root %x, want %s", test.name, tf.Files[0].PiecesRoot, testV2Root)
+		}
+		if len(tf.PieceLayers[tf.Files[0].PiecesRoot]) != len(layer) {
+			t.Errorf("%s: piece layers %x", test.name, tf.PieceLayers)
+		}
+	}
+}
+
+func TestParseTorrentPieceLayers(t *testing.T) {
+	layer := blockHashes([]byte(testV2Data))
+	tampered := append([][32]byte(nil), layer...)
+	tampered[2][0] ^= 1
+	tests := []struct {
+		name  string
+		layer [][32]byte
+		valid bool
+	}{
+		{"valid", layer, true},
+		{"missing", nil, false},
+		{"too short", layer[:2], false},
+		{"tampered", tampered, false},
+	}
+	info := "d9:file tree" + testFileTree(t) + "12:meta versioni2e4:name5:a.txt12:piece lengthi16384ee"
+	for _, test := range tests {
+		pieceLayers := ""
+		if test.layer != nil {
+			pieceLayers = testPieceLayers(t, test.layer)
+		}
+		tf, err := parseTorrent([]byte("d4:info" + info + pieceLayers + "e"))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error %v, want valid %t", test.name, err, test.valid)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+
+		// pieces are checked against the piece layer
+		for index := 0; index < tf.numPieces(); index++ {
+			begin, end := calcPieceBounds(tf, index)
+			buf := []byte(testV2Data[begin:end])
+			if err := tf.checkPiece(index, buf); err != nil {
+				t.Errorf("%s: piece %d: %v", test.name, index, err)
+			}
+			buf[0] ^= 1
+			if err := tf.checkPiece(index, buf); err == nil {
+				t.Errorf("%s: corrupted piece %d passed integrity check", test.name, index)
+			}
+		}
+	}
+}
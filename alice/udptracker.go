@@ -0,0 +1,168 @@
+package alice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP tracker actions (BEP 15).
+const (
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+)
+
+// Requests are retransmitted after 15 * 2^n seconds with n increased up
+// to 8. Announces give up after n reaches 2 so that an unresponsive
+// tracker does not hold up the other trackers of the tier for hours.
+// Connection IDs stay valid for one minute.
+const (
+	udpTimeout             = 15 * time.Second
+	maxUDPRetransmits      = 8
+	maxAnnounceRetransmits = 2
+	connectionIDTimeout    = time.Minute
+	maxUDPPacketSize       = 65536
+)
+
+type cachedConnectionID struct {
+	id       []byte
+	received time.Time
+}
+
+// Connection IDs shared by all torrents, keyed by tracker address.
+var connectionIDs = struct {
+	mu  sync.Mutex
+	ids map[string]cachedConnectionID
+}{ids: make(map[string]cachedConnectionID)}
+
+// Connection to a single UDP tracker.
+type udpTracker struct {
+	conn *net.UDPConn
+	host string
+}
+
+func dialUDPTracker(host string) (*udpTracker, error) {
+	raddr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpTracker{conn: conn, host: host}, nil
+}
+
+func (ut *udpTracker) close() error {
+	return ut.conn.Close()
+}
+
+func (ut *udpTracker) isIPv6() bool {
+	raddr, ok := ut.conn.RemoteAddr().(*net.UDPAddr)
+	return ok && raddr.IP.To4() == nil
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Send request and wait 15 * 2^n seconds for the response with the same
+// transaction ID, responses to earlier requests are ignored.
+//
+// Error responses (action 3) are returned as TrackerError.
+func (ut *udpTracker) roundTrip(req, transactionID []byte, n int) ([]byte, error) {
+	_, err := ut.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ut.conn.SetReadDeadline(time.Now().Add(udpTimeout << n))
+	defer ut.conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		size, err := ut.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if size < 8 || !bytes.Equal(buf[4:8], transactionID) {
+			continue
+		}
+		if binary.BigEndian.Uint32(buf[0:4]) == actionError {
+			return nil, &TrackerError{Tracker: ut.host, Reason: string(buf[8:size])}
+		}
+		res := make([]byte, size)
+		copy(res, buf[:size])
+		return res, nil
+	}
+}
+
+// Return cached connection ID or obtain a new one with a single attempt
+// waiting 15 * 2^n seconds.
+func (ut *udpTracker) connectionID(n int) ([]byte, error) {
+	connectionIDs.mu.Lock()
+	cached, ok := connectionIDs.ids[ut.host]
+	connectionIDs.mu.Unlock()
+	if ok && time.Since(cached.received) < connectionIDTimeout {
+		return cached.id, nil
+	}
+
+	connectReq := newConnect()
+	buf, err := ut.roundTrip(connectReq.serializeConnect(), connectReq.TransactionID, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < connectLen {
+		err := fmt.Errorf("received invalid connect response of length %d", len(buf))
+		return nil, err
+	}
+	connectRes := readConnect(buf)
+	if connectRes.Action != actionConnect {
+		err := fmt.Errorf("expected action %d (connect) received %d", actionConnect, connectRes.Action)
+		return nil, err
+	}
+
+	connectionIDs.mu.Lock()
+	connectionIDs.ids[ut.host] = cachedConnectionID{connectRes.ConnectionID, time.Now()}
+	connectionIDs.mu.Unlock()
+	return connectRes.ConnectionID, nil
+}
+
+func (ut *udpTracker) forgetConnectionID() {
+	connectionIDs.mu.Lock()
+	defer connectionIDs.mu.Unlock()
+	delete(connectionIDs.ids, ut.host)
+}
+
+// Perform request built for a valid connection ID, retransmitting it
+// until the tracker responds or the timeout of the last retransmit
+// expires.
+func (ut *udpTracker) request(retransmits int, build func(connectionID []byte) (req, transactionID []byte)) ([]byte, error) {
+	for n := 0; n <= retransmits; n++ {
+		connectionID, err := ut.connectionID(n)
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		req, transactionID := build(connectionID)
+		res, err := ut.roundTrip(req, transactionID, n)
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			// connection ID might have been rejected
+			ut.forgetConnectionID()
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("tracker %s did not respond", ut.host)
+}
@@ -0,0 +1,147 @@
+package alice
+
+import (
+	"time"
+)
+
+// Largest block peers are allowed to request.
+const maxRequestLength = 128 * 1024
+
+// Blocks sent after each received message, more than one so that the
+// queue drains even if the peer keeps sending requests.
+const uploadsPerMessage = 4
+
+// Block requested by peer from us.
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// Queue block request if it can be served.
+//
+// Requests from choked or uninterested peers, for pieces we do not have
+// or exceeding the queue size are dropped.
+func (ch *Channel) queueUpload(req blockRequest) {
+	if ch.isChoking() || !ch.isInterested() || len(ch.uploads) >= requestQueueSize {
+		return
+	}
+	if req.length <= 0 || req.length > maxRequestLength {
+		return
+	}
+	if !ch.torrent.hasPiece(req.index) {
+		return
+	}
+	ch.uploads = append(ch.uploads, req)
+}
+
+// Remove block request canceled by peer.
+func (ch *Channel) cancelUpload(req blockRequest) {
+	for i, r := range ch.uploads {
+		if r == req {
+			ch.uploads = append(ch.uploads[:i], ch.uploads[i+1:]...)
+			return
+		}
+	}
+}
+
+// Send some of the blocks requested by peer.
+//
+// Only a few blocks are sent at a time so that CANCEL messages sent right
+// after REQUEST messages are still respected.
+func (ch *Channel) serveUploads() error {
+	for i := 0; i < uploadsPerMessage && len(ch.uploads) > 0; i++ {
+		req := ch.uploads[0]
+		ch.uploads = ch.uploads[1:]
+
+		// peer might have been choked in the meantime
+		if ch.isChoking() {
+			ch.uploads = nil
+			return nil
+		}
+
+		block := make([]byte, req.length)
+		_, err := ch.torrent.storage.ReadAt(block, req.index, req.begin)
+		if err != nil {
+			// out of bounds request
+			continue
+		}
+
+		err = ch.send(createPieceMessage(req.index, req.begin, block))
+		if err != nil {
+			return err
+		}
+		ch.uploadRate.add(len(block))
+		ch.torrent.addUploaded(len(block))
+	}
+	return nil
+}
+
+// Keep serving requests until the peer disconnects.
+func (ch *Channel) serve() error {
+	keepAlive := time.NewTicker(2 * time.Minute)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case msg, ok := <-ch.messages:
+			if !ok {
+				return ch.readErr
+			}
+			err := ch.handleMessage(msg)
+			if err != nil {
+				return err
+			}
+			err = ch.serveUploads()
+			if err != nil {
+				return err
+			}
+		case <-keepAlive.C:
+			err := ch.sendKeepAlive()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *Torrent) startSeeder(peer Peer) {
+	ch, err := t.connect(peer)
+	if err != nil {
+		return
+	}
+	t.runSeeder(ch)
+}
+
+// Serve pieces over an established channel (dialed or accepted).
+func (t *Torrent) runSeeder(ch *Channel) {
+	defer ch.close()
+
+	if !t.addChannel(ch) {
+		return
+	}
+	defer t.removeChannel(ch)
+	go ch.readLoop()
+
+	ch.serve()
+}
+
+// Serve pieces to connected and newly discovered peers.
+//
+// Has to be called after Download and blocks forever. Peers are no longer
+// served once OutputToFile is called.
+func (t *Torrent) Seed() {
+	for {
+		select {
+		case peers := <-t.peers:
+			for _, peer := range peers {
+				if t.isConnected(peer) {
+					continue
+				}
+				go t.startSeeder(peer)
+			}
+		case ch := <-t.incoming:
+			go t.runSeeder(ch)
+		}
+	}
+}
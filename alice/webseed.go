@@ -0,0 +1,235 @@
+package alice
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seed server is retried after this long once it fails, the delay
+// doubles with every consecutive failure up to seedMaxBackoff.
+const (
+	seedMinBackoff = 30 * time.Second
+	seedMaxBackoff = 30 * time.Minute
+)
+
+// HTTP server seeding the torrent, scheduled like a peer that has all
+// pieces and downloads them as a whole.
+type seedServer interface {
+	blockSource
+	fetchPiece(tf *TorrentFile, index int) ([]byte, error)
+}
+
+// Server asked to be retried later.
+type retryAfterError struct {
+	url   string
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%s asked to retry after %s", e.url, e.delay)
+}
+
+// Parse delay in seconds, false if value is not a positive number.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// HTTP server hosting the torrent data (BEP 19).
+//
+// URL points to the file of a single-file torrent and to the directory
+// containing the torrent directory of a multi-file torrent. URL ending
+// with a slash gets the torrent name appended for single-file torrents
+// as well.
+type webSeed struct {
+	url    string
+	client *http.Client
+}
+
+func newWebSeed(url string) *webSeed {
+	return &webSeed{
+		url:    url,
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Web seeds have the complete data.
+func (ws *webSeed) hasPiece(index int) bool {
+	return true
+}
+
+// Requests of web seeds cover whole pieces and are not canceled.
+func (ws *webSeed) cancelBlock(index, begin, length int) {}
+
+// Start downloading from web seeds and HTTP seeds of the torrent, only
+// HTTP(S) is supported.
+func (t *Torrent) startWebSeeds(assembleQueue chan *assemble) {
+	for _, u := range t.torrentFile.URLList {
+		if isHTTPURL(u) {
+			go t.runSeedServer(newWebSeed(u), assembleQueue)
+		}
+	}
+	for _, u := range t.torrentFile.HTTPSeeds {
+		if isHTTPURL(u) {
+			go t.runSeedServer(newHTTPSeed(u), assembleQueue)
+		}
+	}
+}
+
+func isHTTPURL(u string) bool {
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")
+}
+
+// Download pieces from the server until all pieces are completed.
+//
+// Failed requests and pieces failing the integrity check put the server
+// on hold, its requests are left to other peers in the meantime.
+func (t *Torrent) runSeedServer(s seedServer, assembleQueue chan *assemble) {
+	failures := 0
+	for {
+		wakeup := t.picker.wakeup()
+		index := t.picker.requestPiece(s)
+		if index == -1 {
+			select {
+			case <-wakeup:
+				continue
+			case <-t.picker.finished():
+				return
+			case <-t.completed:
+				return
+			}
+		}
+
+		buf, err := s.fetchPiece(t.torrentFile, index)
+		if err == nil {
+			err = t.receivePiece(s, index, buf, assembleQueue)
+		}
+		if err == nil {
+			failures = 0
+			select {
+			case <-t.completed:
+				return
+			default:
+			}
+			continue
+		}
+
+		t.picker.dropRequests(s)
+		delay := backoff(failures)
+		if retry, ok := err.(*retryAfterError); ok {
+			// busy server is not failing
+			delay = retry.delay
+		} else {
+			failures++
+		}
+		select {
+		case <-time.After(delay):
+		case <-t.picker.finished():
+			return
+		case <-t.completed:
+			return
+		}
+	}
+}
+
+// Hand piece over to the picker block by block.
+func (t *Torrent) receivePiece(src blockSource, index int, buf []byte, assembleQueue chan *assemble) error {
+	for begin := 0; begin < len(buf); begin += maxBlockSize {
+		end := begin + maxBlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		err := t.receiveBlock(src, index, begin, buf[begin:end], assembleQueue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delay before a server (seed server or trackers) that failed the given
+// number of times in a row (besides the last failure) is used again.
+func backoff(failures int) time.Duration {
+	delay := seedMinBackoff
+	for i := 0; i < failures && delay < seedMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > seedMaxBackoff {
+		delay = seedMaxBackoff
+	}
+	return delay
+}
+
+// Resolve URL of the file on the web seed.
+func (ws *webSeed) fileURL(tf *TorrentFile, f FileInfo) string {
+	if !tf.isMultiFile() {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(tf.Name)
+		}
+		return ws.url
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	path := make([]string, 0, len(f.Path)+1)
+	for _, name := range append([]string{tf.Name}, f.Path...) {
+		path = append(path, url.PathEscape(name))
+	}
+	return base + strings.Join(path, "/")
+}
+
+// Download piece with a Range request for each file it spans. Padding
+// is not requested and is left zero.
+func (ws *webSeed) fetchPiece(tf *TorrentFile, index int) ([]byte, error) {
+	begin, end := calcPieceBounds(tf, index)
+	buf := make([]byte, end-begin)
+	for _, s := range tf.fileSegments(begin, end) {
+		fileURL := ws.fileURL(tf, tf.Files[s.file])
+		err := ws.fetchRange(fileURL, s.offset, buf[s.begin:s.begin+s.length])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Read len(buf) bytes of the file at offset.
+//
+// Servers ignoring the Range header are only accepted for ranges starting
+// at the beginning of the file. Busy servers might ask to be retried
+// later with 503 and a Retry-After header.
+func (ws *webSeed) fetchRange(fileURL string, offset int, buf []byte) error {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+len(buf)-1))
+
+	res, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusServiceUnavailable {
+		if delay, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+			return &retryAfterError{fileURL, delay}
+		}
+	}
+	if res.StatusCode != http.StatusPartialContent && !(res.StatusCode == http.StatusOK && offset == 0) {
+		err := fmt.Errorf("web seed %s responded with %s", fileURL, res.Status)
+		return err
+	}
+	_, err = io.ReadFull(res.Body, buf)
+	return err
+}
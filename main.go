@@ -2,28 +2,134 @@ package main
 
 import (
 	"alice/alice"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 func main() {
-	inputPath := os.Args[1]
-	outputPath := os.Args[2]
+	if len(os.Args) > 1 && os.Args[1] == "create" {
+		create(os.Args[2:])
+		return
+	}
+
+	seed := flag.Bool("seed", false, "keep seeding after download finished")
+	flag.Parse()
+	inputPath := flag.Arg(0)
+	outputPath := flag.Arg(1)
 
-	torrent := alice.NewTorrent(inputPath, outputPath)
+	var torrent *alice.Torrent
+	if strings.HasPrefix(inputPath, "magnet:") {
+		var err error
+		torrent, err = alice.NewTorrentFromMagnet(inputPath, outputPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		torrent = alice.NewTorrent(inputPath, outputPath)
+
+		log.Print("Parsing input")
+		_, err := torrent.ParseTorrent()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	log.Print("Parsing input")
-	_, err := torrent.ParseTorrent()
+	log.Print("Discovering peers")
+	err := torrent.DiscoverPeers()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Print("Discovering peers")
-	torrent.DiscoverPeers()
+	log.Print("Fetching metadata")
+	_, err = torrent.FetchMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// interrupted download is stopped so that the resume file is saved
+	// and trackers are told we stopped
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	log.Print("Starting download")
-	torrent.Download()
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- torrent.Download()
+	}()
+	select {
+	case err := <-downloaded:
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *seed {
+			log.Print("Seeding")
+			go torrent.Seed()
+
+			// seed until interrupted
+			<-interrupt
+		}
+	case <-interrupt:
+	}
 
-	log.Print("Creating file(s)")
-	torrent.OutputToFile()
+	log.Print("Closing file(s)")
+	err = torrent.OutputToFile()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Repeatable string flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Create .torrent file from a file or directory.
+func create(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds listFlag
+	flags.Var(&trackers, "announce", "tracker URL, comma separated URLs form a tier (repeatable)")
+	flags.Var(&webSeeds, "webseed", "web seed URL (repeatable)")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes, chosen automatically if 0")
+	private := flags.Bool("private", false, "only use peers from trackers")
+	source := flags.String("source", "", "source tag")
+	comment := flags.String("comment", "", "comment")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: alice create [flags] [input-path] [torrent-file-path]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	opts := alice.CreateOptions{
+		PieceLength: *pieceLength,
+		Private:     *private,
+		Source:      *source,
+		Comment:     *comment,
+		URLList:     webSeeds,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+
+	log.Print("Hashing pieces")
+	tf, err := alice.CreateTorrent(flags.Arg(0), flags.Arg(1), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Created %s with info hash %x", flags.Arg(1), tf.InfoHash)
 }